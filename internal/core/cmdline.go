@@ -13,6 +13,7 @@ import (
 	"github.com/aacebedo/dnsdock/internal/utils"
 	"github.com/alecthomas/kingpin/v2"
 	"strconv"
+	"strings"
 )
 
 // CommandLine structure handling parameter parsing
@@ -32,7 +33,7 @@ func NewCommandLine(version string) (res *CommandLine) {
 func (cmdline *CommandLine) ParseParameters(rawParams []string) (res *utils.Config, err error) {
 	res = utils.NewConfig()
 
-	nameservers := cmdline.app.Flag("nameserver", "Comma separated list of DNS server(s) for unmatched requests").Default("8.8.8.8:53").Strings()
+	nameservers := cmdline.app.Flag("nameserver", "DNS server for unmatched requests as host:port or tcp://, tls:// and https:// URL, can be repeated").Default("8.8.8.8:53").Strings()
 	dns := cmdline.app.Flag("dns", "Listen DNS requests on this address").Default(res.DnsAddr).Short('d').String()
 	http := cmdline.app.Flag("http", "Listen HTTP requests on this address").Default(res.HttpAddr).Short('t').String()
 	domain := cmdline.app.Flag("domain", "Domain that is appended to all requests").Default(res.Domain.String()).String()
@@ -42,8 +43,56 @@ func (cmdline *CommandLine) ParseParameters(rawParams []string) (res *utils.Conf
 	tlscacert := cmdline.app.Flag("tlscacert", "Path to CA certificate").Default(res.TlsCaCert).String()
 	tlscert := cmdline.app.Flag("tlscert", "Path to Client certificate").Default(res.TlsCert).String()
 	tlskey := cmdline.app.Flag("tlskey", "Path to client certificate private key").Default(res.TlsKey).String()
+	dotAddr := cmdline.app.Flag("dot", "Listen DNS-over-TLS requests on this address").Default(res.DotAddr).String()
+	dotCert := cmdline.app.Flag("dot-cert", "Path to the DNS-over-TLS certificate, the listener is enabled when it is set with --dot-key").Default(res.DotCert).String()
+	dotKey := cmdline.app.Flag("dot-key", "Path to the DNS-over-TLS certificate private key").Default(res.DotKey).String()
+	doqAddr := cmdline.app.Flag("doq", "Listen DNS-over-QUIC requests on this address").Default(res.DoqAddr).String()
+	doqCert := cmdline.app.Flag("doq-cert", "Path to the DNS-over-QUIC certificate, the listener is enabled when it is set with --doq-key").Default(res.DoqCert).String()
+	doqKey := cmdline.app.Flag("doq-key", "Path to the DNS-over-QUIC certificate private key").Default(res.DoqKey).String()
+	doqTimeout := cmdline.app.Flag("doq-timeout", "Idle timeout of the DNS-over-QUIC connections and streams").Default(res.DoqIdleTimeout.String()).Duration()
+	dohAddr := cmdline.app.Flag("doh", "Listen DNS-over-HTTPS requests on this address").Default(res.DohAddr).String()
+	dohCert := cmdline.app.Flag("doh-cert", "Path to the DNS-over-HTTPS certificate, TLS is enabled when it is set with --doh-key").Default(res.DohCert).String()
+	dohKey := cmdline.app.Flag("doh-key", "Path to the DNS-over-HTTPS certificate private key").Default(res.DohKey).String()
+	dnssec := cmdline.app.Flag("dnssec", "Sign the responses of the zone with DNSSEC").Default(strconv.FormatBool(res.Dnssec)).Bool()
+	dnssecKeys := cmdline.app.Flag("dnssec-keys", "Directory of the DNSSEC keys, they are generated in it if they do not exist").Default(res.DnssecKeyDir).String()
+	tsigKeys := cmdline.app.Flag("tsig-key", "TSIG key as name=secret, can be repeated").StringMap()
+	xfrAllow := cmdline.app.Flag("xfr-allow", "Address or network allowed to transfer the zone, can be repeated").Strings()
+	xfrRequireTsig := cmdline.app.Flag("xfr-require-tsig", "Require zone transfers to be signed with a TSIG key").Default(strconv.FormatBool(res.XfrRequireTsig)).Bool()
+	updateKeys := cmdline.app.Flag("update-key", "Name of a TSIG key allowed to send dynamic updates, can be repeated").Strings()
+	exportAddr := cmdline.app.Flag("export", "Primary server receiving the records of the zone as dynamic updates").Default(res.ExportAddr).String()
+	exportZone := cmdline.app.Flag("export-zone", "Zone of the primary server, defaults to the domain").Default(res.ExportZone).String()
+	exportKey := cmdline.app.Flag("export-key", "Name of the TSIG key signing the updates sent to the primary server").Default(res.ExportKey).String()
+	exportOwner := cmdline.app.Flag("export-owner", "Owner marking the records exported by this instance").Default(res.ExportOwner).String()
+	notify := cmdline.app.Flag("notify", "Secondary notified when the zone changes, can be repeated").Strings()
+	notifyKey := cmdline.app.Flag("notify-key", "Name of the TSIG key signing the NOTIFY messages sent to the secondaries").Default(res.NotifyKey).String()
+	soaMname := cmdline.app.Flag("soa-mname", "Primary name server of the SOA record, relative to the domain unless it ends with a dot").Default(res.SoaMname).String()
+	soaRname := cmdline.app.Flag("soa-rname", "Mailbox of the SOA record, relative to the domain unless it ends with a dot").Default(res.SoaRname).String()
+	soaRefresh := cmdline.app.Flag("soa-refresh", "Refresh interval of the SOA record in seconds").Default(strconv.FormatInt(int64(res.SoaRefresh), 10)).Int()
+	soaRetry := cmdline.app.Flag("soa-retry", "Retry interval of the SOA record in seconds").Default(strconv.FormatInt(int64(res.SoaRetry), 10)).Int()
+	soaExpire := cmdline.app.Flag("soa-expire", "Expire time of the SOA record in seconds").Default(strconv.FormatInt(int64(res.SoaExpire), 10)).Int()
+	soaNegTtl := cmdline.app.Flag("soa-negttl", "TTL of negative answers, the TTL is used when it is -1").Default(strconv.FormatInt(int64(res.SoaNegTtl), 10)).Int()
+	nsAddrs := cmdline.app.Flag("ns-address", "Address of the name server answered as glue, can be repeated. Defaults to the address of the DNS listener").Strings()
+	zoneAllow := cmdline.app.Flag("zone-allow", "Address or network allowed to query the zone, can be repeated").Default(res.ZoneAllow...).Strings()
+	recursionAllow := cmdline.app.Flag("recursion-allow", "Address or network allowed to have its queries forwarded to the nameservers, can be repeated").Default(res.RecursionAllow...).Strings()
+	upstreamStrategy := cmdline.app.Flag("upstream-strategy", "Selection of the nameservers of the forwarded queries: sequential, round-robin, random or parallel").Default(res.UpstreamStrategy).Enum("sequential", "round-robin", "random", "parallel")
+	upstreamTimeout := cmdline.app.Flag("upstream-timeout", "Default timeout of the queries sent to the nameservers").Default(res.UpstreamTimeout.String()).Duration()
+	upstreamRetries := cmdline.app.Flag("upstream-retries", "Default number of times a query is sent again to a nameserver before trying the next one").Default(strconv.FormatInt(int64(res.UpstreamRetries), 10)).Int()
+	upstreamHealth := cmdline.app.Flag("upstream-health-interval", "Interval of the health probes of the nameservers, 0 disables the probes").Default(res.UpstreamHealthInterval.String()).Duration()
+	resolvConf := cmdline.app.Flag("resolv-conf", "Forward to the nameservers of this resolv.conf file with its search domains and options, the file is watched for changes").Default(res.ResolvConf).String()
+	forwardRules := cmdline.app.Flag("forward", "Forward the queries of a domain to other nameservers as domain=nameserver,..., can be repeated").Strings()
+	forwardFile := cmdline.app.Flag("forward-file", "File of forwarding rules, one domain=nameserver,... rule per line").Default(res.ForwardFile).String()
+	cacheSize := cmdline.app.Flag("cache-size", "Maximum number of forwarded responses kept in the cache, 0 disables the cache").Default(strconv.FormatInt(int64(res.CacheSize), 10)).Int()
+	cacheMaxTtl := cmdline.app.Flag("cache-max-ttl", "Maximum time in seconds a forwarded response is cached").Default(strconv.FormatInt(int64(res.CacheMaxTtl), 10)).Int()
+	cacheNegTtl := cmdline.app.Flag("cache-neg-ttl", "Maximum time in seconds a negative forwarded response is cached").Default(strconv.FormatInt(int64(res.CacheNegTtl), 10)).Int()
+	cacheStaleTtl := cmdline.app.Flag("cache-stale-ttl", "Time in seconds an expired response is served when the nameservers fail, 0 disables serving stale responses").Default(strconv.FormatInt(int64(res.CacheStaleTtl), 10)).Int()
 	ttl := cmdline.app.Flag("ttl", "TTL for matched requests").Default(strconv.FormatInt(int64(res.Ttl), 10)).Int()
 	createAlias := cmdline.app.Flag("alias", "Automatically create an alias with just the container name.").Default(strconv.FormatBool(res.CreateAlias)).Bool()
+	legacyMX := cmdline.app.Flag("legacy-mx", "Answer MX queries for every container with the container itself as exchange").Default(strconv.FormatBool(res.LegacyMX)).Bool()
+	ednsSize := cmdline.app.Flag("edns-size", "Maximum size of UDP responses to EDNS0 clients, between 512 and 65535").Default(strconv.FormatInt(int64(res.EdnsMaxUDPSize), 10)).Int()
+	cnameDepth := cmdline.app.Flag("cname-depth", "Maximum length of the CNAME chains followed to answer a query").Default(strconv.FormatInt(int64(res.CnameMaxDepth), 10)).Int()
+	txtFields := cmdline.app.Flag("txt-field", "Metadata field answered in TXT records (id, image, provider, created), can be repeated").Default(res.TxtFields...).Strings()
+	txtLabels := cmdline.app.Flag("txt-label", "Container label answered in TXT records, can be repeated").Default(res.TxtLabels...).Strings()
+	networkOrder := cmdline.app.Flag("network-order", "Preferred order of the networks of a container when none of its addresses shares a subnet with the client").Strings()
 	verbose := cmdline.app.Flag("verbose", "Verbose mode.").Default(strconv.FormatBool(res.Verbose)).Short('v').Bool()
 	quiet := cmdline.app.Flag("quiet", "Quiet mode.").Default(strconv.FormatBool(res.Quiet)).Short('q').Bool()
 
@@ -51,7 +100,14 @@ func (cmdline *CommandLine) ParseParameters(rawParams []string) (res *utils.Conf
 
 	res.Verbose = *verbose
 	res.Quiet = *quiet
-	res.Nameservers = *nameservers
+	res.Nameservers = nil
+	for _, value := range *nameservers {
+		ns, err := utils.ParseNameserver(value)
+		if err != nil {
+			return nil, err
+		}
+		res.Nameservers = append(res.Nameservers, ns.String())
+	}
 	res.DnsAddr = *dns
 	res.HttpAddr = *http
 	res.Domain = utils.NewDomain(fmt.Sprintf("%s.%s", *environment, *domain))
@@ -60,7 +116,92 @@ func (cmdline *CommandLine) ParseParameters(rawParams []string) (res *utils.Conf
 	res.TlsCaCert = *tlscacert
 	res.TlsCert = *tlscert
 	res.TlsKey = *tlskey
+	res.DotAddr = *dotAddr
+	res.DotCert = *dotCert
+	res.DotKey = *dotKey
+	res.DoqAddr = *doqAddr
+	res.DoqCert = *doqCert
+	res.DoqKey = *doqKey
+	res.DoqIdleTimeout = *doqTimeout
+	res.DohAddr = *dohAddr
+	res.DohCert = *dohCert
+	res.DohKey = *dohKey
+	res.Dnssec = *dnssec
+	res.DnssecKeyDir = *dnssecKeys
+	res.TsigKeys = make(map[string]string, len(*tsigKeys))
+	for name, secret := range *tsigKeys {
+		// key names are compared as fully qualified lowercase names
+		res.TsigKeys[strings.ToLower(strings.TrimSuffix(name, ".")+".")] = secret
+	}
+	res.UpdateKeys = make([]string, 0, len(*updateKeys))
+	for _, name := range *updateKeys {
+		key := strings.ToLower(strings.TrimSuffix(name, ".") + ".")
+		if _, ok := res.TsigKeys[key]; !ok {
+			return nil, fmt.Errorf("unknown TSIG key '%s' for the dynamic updates", name)
+		}
+		res.UpdateKeys = append(res.UpdateKeys, key)
+	}
+	res.XfrAllow = *xfrAllow
+	res.XfrRequireTsig = *xfrRequireTsig
+	res.NotifyAddrs = *notify
+	if len(*notifyKey) > 0 {
+		res.NotifyKey = strings.ToLower(strings.TrimSuffix(*notifyKey, ".") + ".")
+		if _, ok := res.TsigKeys[res.NotifyKey]; !ok {
+			return nil, fmt.Errorf("unknown TSIG key '%s' for the NOTIFY messages", *notifyKey)
+		}
+	}
+	res.ExportAddr = *exportAddr
+	res.ExportZone = *exportZone
+	if len(*exportKey) > 0 {
+		res.ExportKey = strings.ToLower(strings.TrimSuffix(*exportKey, ".") + ".")
+		if _, ok := res.TsigKeys[res.ExportKey]; !ok {
+			return nil, fmt.Errorf("unknown TSIG key '%s' for the exported updates", *exportKey)
+		}
+	}
+	res.ExportOwner = *exportOwner
+	res.SoaMname = *soaMname
+	res.SoaRname = *soaRname
+	res.SoaRefresh = *soaRefresh
+	res.SoaRetry = *soaRetry
+	res.SoaExpire = *soaExpire
+	res.SoaNegTtl = *soaNegTtl
+	res.NsAddrs = *nsAddrs
 	res.Ttl = *ttl
+	res.ZoneAllow = *zoneAllow
+	res.RecursionAllow = *recursionAllow
+	res.UpstreamStrategy = *upstreamStrategy
+	res.UpstreamTimeout = *upstreamTimeout
+	res.UpstreamRetries = *upstreamRetries
+	res.UpstreamHealthInterval = *upstreamHealth
+	res.ResolvConf = *resolvConf
+	res.ForwardFile = *forwardFile
+	res.ForwardRules = make(map[string][]string)
+	if len(*forwardFile) > 0 {
+		if res.ForwardRules, err = utils.ReadForwardRules(*forwardFile); err != nil {
+			return nil, err
+		}
+	}
+	// the rules of the command line override the ones of the file
+	for _, rule := range *forwardRules {
+		domain, nameservers, err := utils.ParseForwardRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		res.ForwardRules[domain] = nameservers
+	}
+	res.CacheSize = *cacheSize
+	res.CacheMaxTtl = *cacheMaxTtl
+	res.CacheNegTtl = *cacheNegTtl
+	res.CacheStaleTtl = *cacheStaleTtl
 	res.CreateAlias = *createAlias
+	res.NetworkOrder = *networkOrder
+	res.LegacyMX = *legacyMX
+	if *ednsSize < 512 || *ednsSize > 65535 {
+		return nil, fmt.Errorf("invalid EDNS0 UDP size %d, it must be between 512 and 65535", *ednsSize)
+	}
+	res.EdnsMaxUDPSize = *ednsSize
+	res.CnameMaxDepth = *cnameDepth
+	res.TxtFields = *txtFields
+	res.TxtLabels = *txtLabels
 	return
 }
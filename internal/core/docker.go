@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -228,19 +229,51 @@ func (d *DockerManager) getService(id string) (*servers.Service, error) {
 		service.Image = ""
 	}
 	service.Name = cleanContainerName(desc.Name)
+	service.Metadata = map[string]string{
+		servers.MetadataID:      desc.ID,
+		servers.MetadataImage:   desc.Config.Image,
+		servers.MetadataCreated: desc.Created,
+	}
+	service.Labels = desc.Config.Labels
 
 	switch len(desc.NetworkSettings.Networks) {
 	case 0:
 		logger.Warningf("Warning, no IP address found for container '%s' ", desc.Name)
 	default:
-		for _, value := range desc.NetworkSettings.Networks {
+		// iterate in a stable order so that the addresses are always answered in the same order
+		names := make([]string, 0, len(desc.NetworkSettings.Networks))
+		for name := range desc.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value := desc.NetworkSettings.Networks[name]
 			ip := net.ParseIP(value.IPAddress)
 			if ip != nil {
-				service.IPs = append(service.IPs, ip)
+				service.IPs = append(service.IPs, servers.NewAddress(ip, name, value.IPPrefixLen))
+			}
+			ip6 := net.ParseIP(value.GlobalIPv6Address)
+			if ip6 != nil {
+				service.IPs = append(service.IPs, servers.NewAddress(ip6, name, value.GlobalIPv6PrefixLen))
 			}
 		}
 	}
 
+	// ports exposed by the image or published on the host
+	for port := range desc.Config.ExposedPorts {
+		service.Ports = addPort(service.Ports, servers.Port{Port: uint16(port.Int()), Protocol: port.Proto()})
+	}
+	for port := range desc.NetworkSettings.Ports {
+		service.Ports = addPort(service.Ports, servers.Port{Port: uint16(port.Int()), Protocol: port.Proto()})
+	}
+	sort.Slice(service.Ports, func(i, j int) bool {
+		if service.Ports[i].Port != service.Ports[j].Port {
+			return service.Ports[i].Port < service.Ports[j].Port
+		}
+		return service.Ports[i].Protocol < service.Ports[j].Protocol
+	})
+
 	service = overrideFromLabels(service, desc.Config.Labels)
 	service = overrideFromEnv(service, splitEnv(desc.Config.Env))
 	if service == nil {
@@ -295,6 +328,7 @@ func splitEnv(in []string) (out map[string]string) {
 
 func overrideFromLabels(in *servers.Service, labels map[string]string) (out *servers.Service) {
 	var region string
+	records := make(map[string]string)
 	for k, v := range labels {
 		if k == "com.dnsdock.ignore" {
 			return nil
@@ -333,15 +367,49 @@ func overrideFromLabels(in *servers.Service, labels map[string]string) (out *ser
 		if k == "com.dnsdock.ip_addr" {
 			ipAddr := net.ParseIP(v)
 			if ipAddr != nil {
-				in.IPs = in.IPs[:0]
-				in.IPs = append(in.IPs, ipAddr)
+				in.IPs = servers.AddressesFromIPs(ipAddr)
+			}
+		}
+
+		if k == "com.dnsdock.cname" {
+			in.CNAME = v
+		}
+
+		if k == "com.dnsdock.mx.preference" {
+			if preference, err := strconv.ParseUint(v, 10, 16); err == nil {
+				if in.MX == nil {
+					in.MX = &servers.MailExchange{}
+				}
+				in.MX.Preference = uint16(preference)
+			} else {
+				logger.Warningf("Invalid label '%s' of service '%s': %s", k, in.Name, err)
+			}
+		}
+
+		if k == "com.dnsdock.mx.exchange" {
+			if in.MX == nil {
+				in.MX = &servers.MailExchange{}
+			}
+			in.MX.Exchange = v
+		}
+
+		if index, ok := strings.CutPrefix(k, "com.dnsdock.rr."); ok {
+			records[index] = v
+		}
+
+		if name, ok := strings.CutPrefix(k, "com.dnsdock.srv."); ok {
+			port, err := servers.ParsePort(name, v)
+			if err != nil {
+				logger.Warningf("Invalid label '%s' of service '%s': %s", k, in.Name, err)
+			} else {
+				in.Ports = addPort(in.Ports, port)
 			}
 		}
 
 		if k == "com.dnsdock.prefix" {
-			addrs := make([]net.IP, 0)
+			addrs := make([]servers.Address, 0)
 			for _, value := range in.IPs {
-				if strings.HasPrefix(value.String(), v) {
+				if strings.HasPrefix(value.IP.String(), v) {
 					addrs = append(addrs, value)
 				}
 			}
@@ -355,10 +423,42 @@ func overrideFromLabels(in *servers.Service, labels map[string]string) (out *ser
 	if len(region) > 0 {
 		in.Image = in.Image + "." + region
 	}
+
+	// records are kept in the order of their index
+	indexes := make([]string, 0, len(records))
+	for index := range records {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, aerr := strconv.Atoi(indexes[i])
+		b, berr := strconv.Atoi(indexes[j])
+		if aerr == nil && berr == nil {
+			return a < b
+		}
+		return indexes[i] < indexes[j]
+	})
+	for _, index := range indexes {
+		in.Records = append(in.Records, records[index])
+	}
+
 	out = in
 	return
 }
 
+// addPort adds a port to a list, a port which is already in the list is
+// renamed if the new port has a name
+func addPort(ports []servers.Port, port servers.Port) []servers.Port {
+	for i, p := range ports {
+		if p.Port == port.Port && p.Protocol == port.Protocol && (len(p.Name) == 0 || p.Name == port.Name) {
+			if len(port.Name) > 0 {
+				ports[i].Name = port.Name
+			}
+			return ports
+		}
+	}
+	return append(ports, port)
+}
+
 func overrideFromEnv(in *servers.Service, env map[string]string) (out *servers.Service) {
 	var region string
 	for k, v := range env {
@@ -399,15 +499,14 @@ func overrideFromEnv(in *servers.Service, env map[string]string) (out *servers.S
 		if k == "DNSDOCK_IPADDRESS" {
 			ipAddr := net.ParseIP(v)
 			if ipAddr != nil {
-				in.IPs = in.IPs[:0]
-				in.IPs = append(in.IPs, ipAddr)
+				in.IPs = servers.AddressesFromIPs(ipAddr)
 			}
 		}
 
 		if k == "DNSDOCK_PREFIX" {
-			addrs := make([]net.IP, 0)
+			addrs := make([]servers.Address, 0)
 			for _, value := range in.IPs {
-				if strings.HasPrefix(value.String(), v) {
+				if strings.HasPrefix(value.IP.String(), v) {
 					addrs = append(addrs, value)
 				}
 			}
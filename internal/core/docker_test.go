@@ -110,3 +110,53 @@ func TestOverrideFromEnv(t *testing.T) {
 	}
 
 }
+
+func TestOverrideFromLabels(t *testing.T) {
+	getService := func() *servers.Service {
+		service := servers.NewService(DockerProvider)
+		service.Name = "myfoo"
+		service.Image = "mybar"
+		service.Ports = []servers.Port{{Port: 8080, Protocol: "tcp"}}
+		return service
+	}
+
+	s := getService()
+	s = overrideFromLabels(s, map[string]string{"com.dnsdock.ignore": "1"})
+	if s != nil {
+		t.Error("Skipping failed")
+	}
+
+	s = getService()
+	s = overrideFromLabels(s, map[string]string{"com.dnsdock.name": "master", "com.dnsdock.image": "mysql", "com.dnsdock.ttl": "22"})
+	if s.Name != "master" || s.Image != "mysql" || s.TTL != 22 {
+		t.Error("Invalid label override", s)
+	}
+
+	s = getService()
+	s = overrideFromLabels(s, map[string]string{"com.dnsdock.mx.preference": "10", "com.dnsdock.mx.exchange": "mail.docker"})
+	if s.MX == nil || s.MX.Preference != 10 || s.MX.Exchange != "mail.docker" {
+		t.Error("Invalid MX labels", s.MX)
+	}
+
+	s = getService()
+	s = overrideFromLabels(s, map[string]string{"com.dnsdock.rr.10": "c", "com.dnsdock.rr.2": "b", "com.dnsdock.rr.1": "a"})
+	if !reflect.DeepEqual(s.Records, []string{"a", "b", "c"}) {
+		t.Error("Invalid record labels", s.Records)
+	}
+
+	s = getService()
+	s = overrideFromLabels(s, map[string]string{"com.dnsdock.srv.http": "8080/tcp", "com.dnsdock.srv.dns": "53/udp", "com.dnsdock.srv.bad": "foo"})
+	expected := []servers.Port{{Name: "http", Port: 8080, Protocol: "tcp"}, {Name: "dns", Port: 53, Protocol: "udp"}}
+	if len(s.Ports) != len(expected) {
+		t.Fatal("Invalid SRV labels", s.Ports)
+	}
+	for _, port := range expected {
+		found := false
+		for _, actual := range s.Ports {
+			found = found || actual == port
+		}
+		if !found {
+			t.Error("Port", port, "not found in", s.Ports)
+		}
+	}
+}
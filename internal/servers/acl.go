@@ -0,0 +1,92 @@
+/* acl.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// AccessStats holds the counters of the access control decisions
+type AccessStats struct {
+	ZoneAllowed      uint64
+	ZoneRefused      uint64
+	RecursionAllowed uint64
+	RecursionRefused uint64
+}
+
+// accessList is a list of the networks allowed to send a kind of queries,
+// the queries of the other clients are refused
+type accessList struct {
+	name     string
+	networks []*net.IPNet
+	allowed  atomic.Uint64
+	refused  atomic.Uint64
+}
+
+// newAccessList creates an access list from addresses and networks in CIDR
+// notation
+func newAccessList(name string, values []string) *accessList {
+	return &accessList{name: name, networks: parseNetworks(values)}
+}
+
+// open tells whether every client of an address family is allowed
+func (a *accessList) open() bool {
+	for _, network := range a.networks {
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// contains tells whether a client is part of the allowed networks
+func (a *accessList) contains(client net.IP) bool {
+	return containsIP(a.networks, client)
+}
+
+// allow tells whether the query of a client is allowed, the decision is
+// logged and counted
+func (a *accessList) allow(client net.IP, q dns.Question) bool {
+	if !a.contains(client) {
+		a.refused.Add(1)
+		logger.Infof("Refused %s query for '%s' from '%s'", a.name, q.Name, client)
+		return false
+	}
+	a.allowed.Add(1)
+	logger.Debugf("Allowed %s query for '%s' from '%s'", a.name, q.Name, client)
+	return true
+}
+
+// checkAccess refuses the query if its client is not allowed by an access
+// list, it returns false when the query is refused
+func (s *DNSServer) checkAccess(w dns.ResponseWriter, r *dns.Msg, acl *accessList) bool {
+	client := remoteIP(w.RemoteAddr())
+	if len(r.Question) == 0 || acl.allow(client, r.Question[0]) {
+		return true
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	m.RecursionAvailable = s.recursionAccess.contains(client)
+	s.writeMsg(w, r, m)
+	return false
+}
+
+// accessStats returns the counters of the access lists
+func (s *DNSServer) accessStats() AccessStats {
+	return AccessStats{
+		ZoneAllowed:      s.zoneAccess.allowed.Load(),
+		ZoneRefused:      s.zoneAccess.refused.Load(),
+		RecursionAllowed: s.recursionAccess.allowed.Load(),
+		RecursionRefused: s.recursionAccess.refused.Load(),
+	}
+}
@@ -0,0 +1,115 @@
+/* acl_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+func TestAccessLists(t *testing.T) {
+	const UpstreamAddr = "127.0.0.1:9994"
+
+	startUpstream(t, UpstreamAddr, "10.0.0.1", 0)
+
+	var tests = []struct {
+		addr, zoneAllow, recursionAllow string
+		zone, recursion, reverse        int
+		chain                           int
+		stats                           AccessStats
+	}{
+		{"127.0.0.1:9995", "127.0.0.1", "10.0.0.0/8", dns.RcodeSuccess, dns.RcodeRefused, dns.RcodeRefused, 1, AccessStats{ZoneAllowed: 3, RecursionRefused: 3}},
+		{"127.0.0.1:9996", "10.0.0.0/8", "127.0.0.0/8", dns.RcodeRefused, dns.RcodeSuccess, dns.RcodeRefused, 0, AccessStats{ZoneRefused: 3, RecursionAllowed: 1}},
+		{"127.0.0.1:9997", "::/0", "::/0", dns.RcodeRefused, dns.RcodeRefused, dns.RcodeRefused, 0, AccessStats{ZoneRefused: 3, RecursionRefused: 1}},
+		{"127.0.0.1:9999", "127.0.0.1", "127.0.0.1", dns.RcodeSuccess, dns.RcodeSuccess, dns.RcodeSuccess, 2, AccessStats{ZoneAllowed: 3, RecursionAllowed: 3}},
+	}
+
+	for _, input := range tests {
+		t.Log(input.addr)
+		config := utils.NewConfig()
+		config.DnsAddr = input.addr
+		config.Nameservers = []string{UpstreamAddr}
+		config.ZoneAllow = []string{input.zoneAllow}
+		config.RecursionAllow = []string{input.recursionAllow}
+
+		server := NewDNSServer(config)
+		if res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("10.0.0.2"))}); res != nil {
+			t.Error("Error adding service", res)
+		}
+		if res := server.AddService("alias", Service{Name: "alias", Image: "bar", CNAME: "www.example.com"}); res != nil {
+			t.Error("Error adding service", res)
+		}
+		go server.Start() //nolint:errcheck
+
+		// Allow some time for server to start
+		time.Sleep(250 * time.Millisecond)
+
+		exchange := func(name string, qtype uint16) *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion(name, qtype)
+			r, _, err := new(dns.Client).Exchange(m, input.addr)
+			if err != nil {
+				t.Fatal("Error response from the server", err)
+			}
+			return r
+		}
+
+		if r := exchange("foo.bar.docker.", dns.TypeA); r.Rcode != input.zone || r.RecursionAvailable != (input.recursion == dns.RcodeSuccess) {
+			t.Error("Unexpected response to a query of the zone", r)
+		}
+		if r := exchange("example.com.", dns.TypeA); r.Rcode != input.recursion {
+			t.Error("Unexpected response to a forwarded query", r)
+		}
+		// the unknown addresses are forwarded
+		if r := exchange("1.1.168.192.in-addr.arpa.", dns.TypePTR); r.Rcode != input.reverse {
+			t.Error("Unexpected response to a reverse query", r)
+		}
+		// the targets of the CNAME records are only resolved for the
+		// clients allowed to recurse
+		if r := exchange("alias.bar.docker.", dns.TypeA); len(r.Answer) != input.chain {
+			t.Error("Unexpected response to a query of an alias", r)
+		}
+		if stats := server.Stats().Access; stats != input.stats {
+			t.Error("Unexpected access counters", stats)
+		}
+
+		if err := server.Stop(); err != nil {
+			t.Error("Error stopping server", err)
+		}
+	}
+}
+
+func TestDefaultRecursionAccess(t *testing.T) {
+	acl := newAccessList("recursion", utils.NewConfig().RecursionAllow)
+	if acl.open() {
+		t.Error("The forwarding should not be open by default")
+	}
+
+	// the docker bridges are part of the private networks
+	for client, expected := range map[string]bool{
+		"127.0.0.1":   true,
+		"172.17.0.2":  true,
+		"fd00::2":     true,
+		"fe80::1":     true,
+		"8.8.8.8":     false,
+		"2001:db8::1": false,
+	} {
+		if acl.contains(net.ParseIP(client)) != expected {
+			t.Error(client, "Expected allowed:", expected)
+		}
+	}
+
+	if !newAccessList("recursion", []string{"0.0.0.0/0", "::/0"}).open() {
+		t.Error("The forwarding should be open")
+	}
+}
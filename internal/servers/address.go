@@ -0,0 +1,105 @@
+/* address.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// Address represents an IP address of a service and the network it is
+// reachable on. Network and Subnet are empty for addresses which were not
+// discovered on a network (API or label overrides).
+type Address struct {
+	IP      net.IP
+	Network string     `json:",omitempty"`
+	Subnet  *net.IPNet `json:"-"`
+}
+
+// NewAddress creates a new address on the given network. The subnet is
+// computed from the prefix length, it is left empty if the prefix length is 0.
+func NewAddress(ip net.IP, network string, prefixLen int) Address {
+	addr := Address{IP: ip, Network: network}
+	if prefixLen > 0 {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		mask := net.CIDRMask(prefixLen, bits)
+		addr.Subnet = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return addr
+}
+
+func (a Address) String() string {
+	if len(a.Network) > 0 {
+		return fmt.Sprintf("%s (%s)", a.IP, a.Network)
+	}
+	return a.IP.String()
+}
+
+// Contains tells whether the given IP is in the subnet of the address
+func (a Address) Contains(ip net.IP) bool {
+	return a.Subnet != nil && a.Subnet.Contains(ip)
+}
+
+type jsonAddress struct {
+	IP      net.IP
+	Network string `json:",omitempty"`
+	Subnet  string `json:",omitempty"`
+}
+
+// MarshalJSON encodes the address as a plain IP string when it has no network
+// information so that the API stays compatible with bare IP lists
+func (a Address) MarshalJSON() ([]byte, error) {
+	if len(a.Network) == 0 && a.Subnet == nil {
+		return json.Marshal(a.IP)
+	}
+
+	res := jsonAddress{IP: a.IP, Network: a.Network}
+	if a.Subnet != nil {
+		res.Subnet = a.Subnet.String()
+	}
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON decodes an address either from a plain IP string or from an
+// object with IP, Network and Subnet properties
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var ip net.IP
+	if err := json.Unmarshal(data, &ip); err == nil {
+		*a = Address{IP: ip}
+		return nil
+	}
+
+	var input jsonAddress
+	if err := json.Unmarshal(data, &input); err != nil {
+		return err
+	}
+
+	*a = Address{IP: input.IP, Network: input.Network}
+	if len(input.Subnet) > 0 {
+		_, subnet, err := net.ParseCIDR(input.Subnet)
+		if err != nil {
+			return err
+		}
+		a.Subnet = subnet
+	}
+	return nil
+}
+
+// AddressesFromIPs creates addresses without network information
+func AddressesFromIPs(ips ...net.IP) []Address {
+	res := make([]Address, 0, len(ips))
+	for _, ip := range ips {
+		res = append(res, Address{IP: ip})
+	}
+	return res
+}
@@ -0,0 +1,236 @@
+/* cache.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// TTL of the stale answers, as recommended by RFC 8767 sec. 4
+const staleAnswerTTL = 30
+
+// CacheStats holds the counters of the cache of the forwarded responses
+type CacheStats struct {
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Stale     uint64
+	Evictions uint64
+}
+
+// cacheEntry is a cached response, it is fresh until it expires and may be
+// served stale until it is purged
+type cacheEntry struct {
+	key     string
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+	purged  time.Time
+}
+
+// forwardCache caches the responses of the nameservers by question. The
+// least recently used entries are evicted when the cache is full.
+type forwardCache struct {
+	size     int
+	maxTTL   time.Duration
+	negTTL   time.Duration
+	staleTTL time.Duration
+	entries  map[string]*list.Element
+	lru      *list.List
+	counters CacheStats
+	now      func() time.Time
+	lock     sync.Mutex
+}
+
+// newForwardCache creates a cache of the forwarded responses, it does not
+// cache anything when its size is 0
+func newForwardCache(c *utils.Config) *forwardCache {
+	return &forwardCache{
+		size:     c.CacheSize,
+		maxTTL:   time.Duration(c.CacheMaxTtl) * time.Second,
+		negTTL:   time.Duration(c.CacheNegTtl) * time.Second,
+		staleTTL: time.Duration(c.CacheStaleTtl) * time.Second,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// cacheKey returns the key of the response to a request, responses with
+// DNSSEC records are cached separately
+func cacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return strings.ToLower(q.Name) + " " + strconv.Itoa(int(q.Qclass)) + " " + strconv.Itoa(int(q.Qtype)) +
+		" " + strconv.FormatBool(do) + " " + strconv.FormatBool(r.CheckingDisabled)
+}
+
+// cacheTTL returns how long a response can be cached. Negative responses are
+// cached for the TTL of the SOA record of the authority section as per RFC
+// 2308 sec. 5, they are not cached without one.
+func (c *forwardCache) cacheTTL(m *dns.Msg) time.Duration {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+
+	if m.Rcode == dns.RcodeNameError || len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return min(time.Duration(min(soa.Hdr.Ttl, soa.Minttl))*time.Second, c.negTTL)
+			}
+		}
+		return 0
+	}
+
+	ttl := c.maxTTL
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			}
+		}
+	}
+	return ttl
+}
+
+// set caches the response to a request
+func (c *forwardCache) set(r *dns.Msg, m *dns.Msg) {
+	if c.size == 0 {
+		return
+	}
+	ttl := c.cacheTTL(m)
+	if ttl <= 0 {
+		return
+	}
+
+	msg := m.Copy()
+	// the OPT record is added back for EDNS0 clients when the response is written
+	extra := make([]dns.RR, 0, len(msg.Extra))
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	now := c.now()
+	entry := &cacheEntry{key: cacheKey(r), msg: msg, stored: now, expires: now.Add(ttl), purged: now.Add(ttl + c.staleTTL)}
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.counters.Evictions++
+	}
+}
+
+// get returns the cached response to a request if it is fresh
+func (c *forwardCache) get(r *dns.Msg) *dns.Msg {
+	if c.size == 0 {
+		return nil
+	}
+	return c.lookup(r, false)
+}
+
+// getStale returns the cached response to a request even if it expired, it
+// is used when the nameservers cannot be reached as per RFC 8767
+func (c *forwardCache) getStale(r *dns.Msg) *dns.Msg {
+	if c.size == 0 || c.staleTTL == 0 {
+		return nil
+	}
+	return c.lookup(r, true)
+}
+
+// lookup returns a copy of a cached response with the TTL of its records
+// decreased by its age
+func (c *forwardCache) lookup(r *dns.Msg, stale bool) *dns.Msg {
+	key := cacheKey(r)
+
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	now := c.now()
+
+	elem, ok := c.entries[key]
+	if ok && !now.Before(elem.Value.(*cacheEntry).purged) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok || (!stale && !now.Before(elem.Value.(*cacheEntry).expires)) {
+		if !stale {
+			c.counters.Misses++
+		}
+		return nil
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	c.lru.MoveToFront(elem)
+	if stale {
+		c.counters.Stale++
+	} else {
+		c.counters.Hits++
+	}
+
+	m := entry.msg.Copy()
+	m.Id = r.Id
+	m.Question = []dns.Question{r.Question[0]}
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case !now.Before(entry.expires):
+				hdr.Ttl = staleAnswerTTL
+			case hdr.Ttl > age:
+				hdr.Ttl -= age
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// flush removes all the cached responses
+func (c *forwardCache) flush() {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// stats returns the counters of the cache
+func (c *forwardCache) stats() CacheStats {
+	defer c.lock.Unlock()
+	c.lock.Lock()
+
+	res := c.counters
+	res.Entries = c.lru.Len()
+	return res
+}
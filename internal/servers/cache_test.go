@@ -0,0 +1,167 @@
+/* cache_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// testResponse creates the response to a question with the given records
+func testResponse(name string, qtype uint16, rcode int, answer []string, ns []string) (*dns.Msg, *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	for _, record := range answer {
+		rr, _ := dns.NewRR(record)
+		m.Answer = append(m.Answer, rr)
+	}
+	for _, record := range ns {
+		rr, _ := dns.NewRR(record)
+		m.Ns = append(m.Ns, rr)
+	}
+	return r, m
+}
+
+func TestForwardCache(t *testing.T) {
+	config := utils.NewConfig()
+	config.CacheSize = 2
+	config.CacheStaleTtl = 3600
+
+	cache := newForwardCache(config)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	r, m := testResponse("example.com.", dns.TypeA, dns.RcodeSuccess, []string{"example.com. 60 IN A 10.0.0.1"}, nil)
+	cache.set(r, m)
+
+	now = now.Add(10 * time.Second)
+	r.Id = 1234
+	if res := cache.get(r); res == nil || res.Id != 1234 || res.Answer[0].Header().Ttl != 50 {
+		t.Error("Expected a cached response with a decreased TTL Got:", res)
+	}
+
+	// expired responses are only served stale
+	now = now.Add(time.Minute)
+	if res := cache.get(r); res != nil {
+		t.Error("Expired response should not be served Got:", res)
+	}
+	if res := cache.getStale(r); res == nil || res.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Error("Expected a stale response Got:", res)
+	}
+	now = now.Add(time.Hour)
+	if res := cache.getStale(r); res != nil {
+		t.Error("Purged response should not be served Got:", res)
+	}
+
+	// negative responses are cached for the TTL of the SOA record
+	soa := []string{"example.com. 3600 IN SOA ns. mbox. 1 0 0 0 10"}
+	r, m = testResponse("missing.example.com.", dns.TypeA, dns.RcodeNameError, nil, soa)
+	cache.set(r, m)
+	if res := cache.get(r); res == nil || res.Rcode != dns.RcodeNameError {
+		t.Error("Expected a cached negative response Got:", res)
+	}
+	now = now.Add(11 * time.Second)
+	if res := cache.get(r); res != nil {
+		t.Error("Negative response should expire with the SOA minimum Got:", res)
+	}
+
+	for _, response := range []struct {
+		rcode int
+		ns    []string
+	}{
+		{dns.RcodeNameError, nil},
+		{dns.RcodeServerFailure, soa},
+	} {
+		r, m = testResponse("uncached.example.com.", dns.TypeA, response.rcode, nil, response.ns)
+		cache.set(r, m)
+		if res := cache.get(r); res != nil {
+			t.Error("Response should not be cached", response)
+		}
+	}
+
+	// the least recently used responses are evicted
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		r, m = testResponse(name, dns.TypeA, dns.RcodeSuccess, []string{name + " 60 IN A 10.0.0.1"}, nil)
+		cache.set(r, m)
+	}
+	r, _ = testResponse("a.example.com.", dns.TypeA, dns.RcodeSuccess, nil, nil)
+	if res := cache.get(r); res != nil {
+		t.Error("Least recently used response should be evicted")
+	}
+	if stats := cache.stats(); stats.Entries != 2 || stats.Evictions != 2 || stats.Hits != 2 || stats.Stale != 1 {
+		t.Error("Unexpected cache counters", stats)
+	}
+}
+
+func TestForwardCacheServer(t *testing.T) {
+	const TestAddr = "127.0.0.1:9978"
+	const UpstreamAddr = "127.0.0.1:9979"
+
+	var queries atomic.Int32
+	started := make(chan struct{})
+	upstream := &dns.Server{Addr: UpstreamAddr, Net: "udp", NotifyStartedFunc: func() { close(started) }, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		_, m := testResponse(r.Question[0].Name, dns.TypeA, dns.RcodeSuccess, []string{"example.com. 60 IN A 10.0.0.1"}, nil)
+		m.Id = r.Id
+		w.WriteMsg(m) //nolint:errcheck
+	})}
+	go upstream.ListenAndServe() //nolint:errcheck
+	<-started
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	exchange := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return r
+	}
+
+	for i := 0; i < 3; i++ {
+		if r := exchange(); len(r.Answer) != 1 {
+			t.Error("Expected the answer of the nameserver Got:", r)
+		}
+	}
+	if queries.Load() != 1 {
+		t.Error("Nameserver should be queried once Got:", queries.Load())
+	}
+
+	// stale answers are served when the nameserver fails
+	upstream.Shutdown() //nolint:errcheck
+	server.cache.lock.Lock()
+	server.cache.now = func() time.Time { return time.Now().Add(time.Hour) }
+	server.cache.lock.Unlock()
+	if r := exchange(); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Error("Expected a stale answer Got:", r)
+	}
+	if stats := server.Stats(); stats.Cache.Hits != 2 || stats.Cache.Stale != 1 {
+		t.Error("Unexpected cache counters", stats)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
@@ -0,0 +1,104 @@
+/* cname.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+func (s *DNSServer) makeServiceCNAME(n string, service *Service) dns.RR {
+	rr := new(dns.CNAME)
+
+	rr.Hdr = dns.RR_Header{
+		Name:   n,
+		Rrtype: dns.TypeCNAME,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(s.getTTL(service)),
+	}
+
+	rr.Target = dns.Fqdn(service.CNAME)
+
+	return rr
+}
+
+// isLocalName tells whether a name is answered by the server, that is if it
+// is part of the domain or of an alias of a service
+func (s *DNSServer) isLocalName(name string) bool {
+	name = dns.Fqdn(name)
+	if dns.IsSubDomain(s.config.Domain.String()+".", name) {
+		return true
+	}
+
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	for _, service := range s.services {
+		for _, alias := range service.Aliases {
+			if dns.IsSubDomain(dns.Fqdn(alias), name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// chaseCNAME follows a chain of CNAME records starting at the given record
+// and returns the records of the chain up to the records answering the
+// query. Names of the domain are resolved locally, other names are resolved
+// through the nameservers if the client is allowed to recurse. The rcode of the last name of the chain is
+// returned, loops and chains longer than the configured maximum are
+// failures.
+func (s *DNSServer) chaseCNAME(r *dns.Msg, cname *dns.CNAME, client net.IP) (chain []dns.RR, rcode int) {
+	qtype := r.Question[0].Qtype
+	visited := map[string]bool{strings.ToLower(dns.Fqdn(cname.Hdr.Name)): true}
+
+	for depth := 1; ; depth++ {
+		target := strings.ToLower(cname.Target)
+		if visited[target] {
+			logger.Warningf("CNAME loop detected for query '%s' at '%s'", r.Question[0].Name, target)
+			return chain, dns.RcodeServerFailure
+		}
+		visited[target] = true
+
+		if !s.isLocalName(target) {
+			q := new(dns.Msg)
+			q.SetQuestion(cname.Target, qtype)
+			// the clients which may not recurse only get the chain
+			if !s.recursionAccess.allow(client, q.Question[0]) {
+				return chain, dns.RcodeSuccess
+			}
+			in, err := s.forward(q)
+			if err != nil {
+				logger.Warningf("Unable to resolve CNAME target '%s': %s", cname.Target, err)
+				return chain, dns.RcodeServerFailure
+			}
+			return append(chain, in.Answer...), in.Rcode
+		}
+
+		answer, _, found := s.answer(cname.Target, qtype, client)
+		if !found {
+			return chain, dns.RcodeNameError
+		}
+
+		if len(answer) == 0 || answer[len(answer)-1].Header().Rrtype != dns.TypeCNAME {
+			return append(chain, answer...), dns.RcodeSuccess
+		}
+
+		if depth >= s.config.CnameMaxDepth {
+			logger.Warningf("CNAME chain for query '%s' is longer than %d", r.Question[0].Name, s.config.CnameMaxDepth)
+			return chain, dns.RcodeServerFailure
+		}
+		chain = append(chain, answer...)
+		cname = answer[len(answer)-1].(*dns.CNAME)
+	}
+}
@@ -0,0 +1,310 @@
+/* dnssec.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// signatures are valid for a week and renewed when half of their
+	// validity has passed
+	signatureValidity = 7 * 24 * time.Hour
+	// signatures are valid a bit before their creation to allow for clock skew
+	signatureSkew = time.Hour
+	// maximum number of cached signatures, the cache is flushed when it is full
+	signatureCacheSize = 10000
+)
+
+// dnssecKey represents a DNSSEC key pair
+type dnssecKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// signer signs the records of the zone with a key signing key, used for the
+// DNSKEY records, and a zone signing key, used for the other records.
+// Signatures are cached until the services change.
+type signer struct {
+	ksk   dnssecKey
+	zsk   dnssecKey
+	cache map[string]*dns.RRSIG
+	lock  sync.Mutex
+}
+
+// newSigner creates a signer for a zone. The keys are loaded from the given
+// directory, they are generated and saved in the directory if they do not
+// exist. Keys generated without a directory change on every start.
+func newSigner(zone string, dir string) (*signer, error) {
+	ksk, err := loadOrGenerateKey(zone, dir, "ksk", 257)
+	if err != nil {
+		return nil, err
+	}
+	zsk, err := loadOrGenerateKey(zone, dir, "zsk", 256)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("DNSSEC signing of '%s' enabled, DS record: %s", zone, ksk.key.ToDS(dns.SHA256))
+
+	return &signer{ksk: ksk, zsk: zsk, cache: make(map[string]*dns.RRSIG)}, nil
+}
+
+// loadOrGenerateKey loads a key from the files <name>.key and <name>.private
+// of a directory, which use the BIND format
+func loadOrGenerateKey(zone, dir, name string, flags uint16) (dnssecKey, error) {
+	if len(dir) == 0 {
+		logger.Warningf("No DNSSEC key directory, the %s is generated and changes on every start", strings.ToUpper(name))
+		return generateKey(zone, flags)
+	}
+
+	pubFile := filepath.Join(dir, name+".key")
+	privFile := filepath.Join(dir, name+".private")
+
+	pub, err := os.ReadFile(pubFile)
+	if errors.Is(err, os.ErrNotExist) {
+		res, err := generateKey(zone, flags)
+		if err != nil {
+			return res, err
+		}
+		if err := os.WriteFile(pubFile, []byte(res.key.String()+"\n"), 0644); err != nil {
+			return res, err
+		}
+		if err := os.WriteFile(privFile, []byte(res.key.PrivateKeyString(res.priv)), 0600); err != nil {
+			return res, err
+		}
+		logger.Infof("Generated DNSSEC %s '%s'", strings.ToUpper(name), pubFile)
+		return res, nil
+	} else if err != nil {
+		return dnssecKey{}, err
+	}
+
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return dnssecKey{}, fmt.Errorf("invalid DNSSEC key '%s': %s", pubFile, err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return dnssecKey{}, fmt.Errorf("invalid DNSSEC key '%s': not a DNSKEY record", pubFile)
+	}
+
+	f, err := os.Open(privFile)
+	if err != nil {
+		return dnssecKey{}, err
+	}
+	defer f.Close()
+
+	priv, err := key.ReadPrivateKey(f, privFile)
+	if err != nil {
+		return dnssecKey{}, fmt.Errorf("invalid DNSSEC private key '%s': %s", privFile, err)
+	}
+	privSigner, ok := priv.(crypto.Signer)
+	if !ok {
+		return dnssecKey{}, fmt.Errorf("unsupported DNSSEC private key '%s'", privFile)
+	}
+
+	key.Hdr.Name = zone
+	key.Flags = flags
+	return dnssecKey{key: key, priv: privSigner}, nil
+}
+
+// generateKey generates an ECDSA P-256 key pair
+func generateKey(zone string, flags uint16) (dnssecKey, error) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return dnssecKey{}, err
+	}
+	return dnssecKey{key: key, priv: priv.(crypto.Signer)}, nil
+}
+
+// dnskeys returns the DNSKEY records of a zone
+func (g *signer) dnskeys(zone string, ttl uint32) []dns.RR {
+	res := make([]dns.RR, 0, 2)
+	for _, k := range []dnssecKey{g.ksk, g.zsk} {
+		key := dns.Copy(k.key).(*dns.DNSKEY)
+		key.Hdr.Name = zone
+		key.Hdr.Ttl = ttl
+		res = append(res, key)
+	}
+	return res
+}
+
+// flush removes the cached signatures
+func (g *signer) flush() {
+	defer g.lock.Unlock()
+	g.lock.Lock()
+	g.cache = make(map[string]*dns.RRSIG)
+}
+
+// sign returns the signature of a RRset, the cached signature is used if the
+// RRset did not change
+func (g *signer) sign(rrset []dns.RR, zone string) (*dns.RRSIG, error) {
+	k := g.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		k = g.ksk
+	}
+
+	rrs := make([]string, 0, len(rrset)+1)
+	for _, rr := range rrset {
+		rrs = append(rrs, rr.String())
+	}
+	slices.Sort(rrs)
+	id := zone + "\n" + strings.Join(rrs, "\n")
+
+	defer g.lock.Unlock()
+	g.lock.Lock()
+
+	now := time.Now()
+	if sig, ok := g.cache[id]; ok && now.Before(time.Unix(int64(sig.Expiration), 0).Add(-signatureValidity/2)) {
+		return dns.Copy(sig).(*dns.RRSIG), nil
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(now.Add(-signatureSkew).Unix()),
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+		KeyTag:     k.key.KeyTag(),
+		SignerName: zone,
+	}
+	if err := sig.Sign(k.priv, rrset); err != nil {
+		return nil, err
+	}
+
+	if len(g.cache) >= signatureCacheSize {
+		g.cache = make(map[string]*dns.RRSIG)
+	}
+	g.cache[id] = sig
+
+	return dns.Copy(sig).(*dns.RRSIG), nil
+}
+
+// signerZone returns the zone which signs the records of a name, it is empty
+// when the name is not served by the DNSServer
+func (s *DNSServer) signerZone(name string) string {
+	for _, zone := range []string{s.config.Domain.String() + ".", "in-addr.arpa.", "ip6.arpa."} {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// signSection adds the signatures of the RRsets of a message section. Records
+// which are not served by the DNSServer (forwarded CNAME targets) are not
+// signed.
+func (s *DNSServer) signSection(rrs []dns.RR) []dns.RR {
+	// RRsets are made of the records with the same name, type and class,
+	// wherever they are in the section
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+		class  uint16
+	}
+	keys := make([]rrsetKey, 0, len(rrs))
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		key := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype, hdr.Class}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	res := make([]dns.RR, 0, 2*len(rrs))
+	for _, key := range keys {
+		rrset := rrsets[key]
+		res = append(res, rrset...)
+
+		zone := s.signerZone(key.name)
+		if len(zone) == 0 || key.rrtype == dns.TypeRRSIG || key.rrtype == dns.TypeOPT {
+			continue
+		}
+		sig, err := s.signer.sign(rrset, zone)
+		if err != nil {
+			logger.Errorf("Unable to sign records of '%s': %s", rrset[0].Header().Name, err)
+			continue
+		}
+		res = append(res, sig)
+	}
+	return res
+}
+
+// signMsg signs the records of a response
+func (s *DNSServer) signMsg(m *dns.Msg) {
+	m.Answer = s.signSection(m.Answer)
+	m.Ns = s.signSection(m.Ns)
+	m.Extra = s.signSection(m.Extra)
+}
+
+// doDNSSEC tells whether a response to the request must be signed
+func (s *DNSServer) doDNSSEC(r *dns.Msg) bool {
+	if s.signer == nil {
+		return false
+	}
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// makeDenial creates the NSEC record proving that no record of the requested
+// type exists for a name. Non existing names are answered with the same
+// minimally covering record (NSEC "black lies"), which only lists the NSEC
+// and RRSIG types. The next name is the immediate successor of the name so
+// that the record covers nothing else. Its TTL is the negative TTL of the SOA
+// record as per RFC 4035 sec. 2.3.
+func (s *DNSServer) makeDenial(name string, types []uint16) dns.RR {
+	types = append(types, dns.TypeNSEC, dns.TypeRRSIG)
+	slices.Sort(types)
+
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(s.negativeTTL()),
+		},
+		NextDomain: "\\000." + name,
+		TypeBitMap: slices.Compact(types),
+	}
+}
+
+// typesAt returns the types of the records which exist for a name of the domain
+func (s *DNSServer) typesAt(name string, client net.IP) []uint16 {
+	types := make([]uint16, 0)
+	if strings.EqualFold(name, s.config.Domain.String()+".") {
+		types = append(types, dns.TypeSOA, dns.TypeDNSKEY)
+	}
+	for _, rr := range s.queryRecords(strings.TrimSuffix(name, ".")) {
+		types = append(types, rr.Header().Rrtype)
+	}
+	for _, qtype := range []uint16{dns.TypeNS, dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeTXT, dns.TypeSRV} {
+		if answer, _, _ := s.answer(name, qtype, client); len(answer) > 0 {
+			types = append(types, qtype)
+		}
+	}
+	return types
+}
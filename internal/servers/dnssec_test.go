@@ -0,0 +1,234 @@
+/* dnssec_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// verifySection checks that every RRset of a section is signed by one of the keys
+func verifySection(t *testing.T, rrs []dns.RR, keys map[uint16]*dns.DNSKEY) {
+	rrsets := make(map[uint16][]dns.RR)
+	sigs := make(map[uint16]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[sig.TypeCovered] = sig
+		} else {
+			rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+		}
+	}
+
+	for rrtype, rrset := range rrsets {
+		sig, ok := sigs[rrtype]
+		if !ok {
+			t.Error("RRset is not signed", dns.TypeToString[rrtype])
+			continue
+		}
+		key, ok := keys[sig.KeyTag]
+		if !ok {
+			t.Error("Unknown key", sig.KeyTag)
+			continue
+		}
+		if err := sig.Verify(key, rrset); err != nil || !sig.ValidityPeriod(time.Now()) {
+			t.Error("Invalid signature of", dns.TypeToString[rrtype], err)
+		}
+	}
+}
+
+func TestDNSResponseDNSSEC(t *testing.T) {
+	const TestAddr = "127.0.0.1:9969"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Dnssec = true
+	config.DnssecKeyDir = t.TempDir()
+	config.SoaNegTtl = 30
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	if res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	exchange := func(name string, qtype uint16, do bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.SetEdns0(4096, do)
+		r, _, err := new(dns.Client).Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return r
+	}
+
+	r := exchange("docker.", dns.TypeDNSKEY, true)
+	keys := make(map[uint16]*dns.DNSKEY)
+	for _, rr := range r.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys[key.KeyTag()] = key
+		}
+	}
+	if len(keys) != 2 {
+		t.Fatal("Expected a KSK and a ZSK Got:", r.Answer)
+	}
+	verifySection(t, r.Answer, keys)
+
+	// the reverse zones are signed with their own DNSKEY records
+	reverseKeys := make(map[string]map[uint16]*dns.DNSKEY)
+	for _, zone := range []string{"in-addr.arpa.", "ip6.arpa."} {
+		reverseKeys[zone] = make(map[uint16]*dns.DNSKEY)
+		r = exchange(zone, dns.TypeDNSKEY, true)
+		for _, rr := range r.Answer {
+			if key, ok := rr.(*dns.DNSKEY); ok && key.Hdr.Name == zone {
+				reverseKeys[zone][key.KeyTag()] = key
+			}
+		}
+		if len(r.Answer) != 3 || len(reverseKeys[zone]) != 2 {
+			t.Error("Expected the keys of the reverse zone Got:", r.Answer)
+		}
+		verifySection(t, r.Answer, reverseKeys[zone])
+	}
+	r = exchange("1.0.0.127.in-addr.arpa.", dns.TypePTR, true)
+	if len(r.Answer) != 3 {
+		t.Error("Expected signed PTR records Got:", r.Answer)
+	}
+	verifySection(t, r.Answer, reverseKeys["in-addr.arpa."])
+
+	var tests = []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"foo.bar.docker.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"docker.", dns.TypeSOA, dns.RcodeSuccess, 2},
+		// NODATA and NXDOMAIN are denied with a NSEC record
+		{"foo.bar.docker.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"missing.docker.", dns.TypeA, dns.RcodeSuccess, 0},
+	}
+	for _, input := range tests {
+		r := exchange(input.name, input.qtype, true)
+		if r.Rcode != input.rcode || len(r.Answer) != input.answer {
+			t.Error(input, "Unexpected response", r)
+			continue
+		}
+		verifySection(t, r.Answer, keys)
+		verifySection(t, r.Ns, keys)
+
+		if input.answer == 0 {
+			var nsec *dns.NSEC
+			for _, rr := range r.Ns {
+				if rr, ok := rr.(*dns.NSEC); ok {
+					nsec = rr
+				}
+			}
+			if nsec == nil || nsec.Header().Name != input.name || slices.Contains(nsec.TypeBitMap, input.qtype) {
+				t.Error(input, "Expected a NSEC record denying the type Got:", r.Ns)
+			} else if nsec.Hdr.Ttl != 30 {
+				t.Error(input, "NSEC record should have the negative TTL Got:", nsec.Hdr.Ttl)
+			}
+		}
+	}
+
+	r = exchange("foo.bar.docker.", dns.TypeAAAA, true)
+	for _, rr := range r.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok && !slices.Contains(nsec.TypeBitMap, dns.TypeA) {
+			t.Error("NSEC record should list the existing types Got:", nsec)
+		}
+	}
+
+	// responses are not signed for clients which do not ask for it
+	r = exchange("foo.bar.docker.", dns.TypeA, false)
+	if len(r.Answer) != 1 {
+		t.Error("Unexpected unsigned answer", r.Answer)
+	}
+	r = exchange("missing.docker.", dns.TypeA, false)
+	if r.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN Got:", dns.RcodeToString[r.Rcode])
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+
+	// the keys are loaded from the directory
+	signer, err := newSigner("docker.", config.DnssecKeyDir)
+	if err != nil {
+		t.Fatal("Error loading keys", err)
+	}
+	if _, ok := keys[signer.ksk.key.KeyTag()]; !ok {
+		t.Error("KSK should be loaded from the key directory")
+	}
+	if _, ok := keys[signer.zsk.key.KeyTag()]; !ok {
+		t.Error("ZSK should be loaded from the key directory")
+	}
+}
+
+func TestSignerCache(t *testing.T) {
+	signer, err := newSigner("docker.", "")
+	if err != nil {
+		t.Fatal("Error generating keys", err)
+	}
+
+	rr, _ := dns.NewRR("foo.docker. 0 IN A 127.0.0.1")
+	sig, err := signer.sign([]dns.RR{rr}, "docker.")
+	if err != nil {
+		t.Fatal("Error signing", err)
+	}
+	if cached, _ := signer.sign([]dns.RR{rr}, "docker."); cached.Signature != sig.Signature {
+		t.Error("Signature should be cached")
+	}
+
+	signer.flush()
+	if res, _ := signer.sign([]dns.RR{rr}, "docker."); res.Signature == sig.Signature {
+		t.Error("Signature should be computed again after a flush")
+	}
+}
+
+func TestSignSection(t *testing.T) {
+	config := utils.NewConfig()
+	config.Dnssec = true
+	server := NewDNSServer(config)
+
+	rrs := make([]dns.RR, 0, 4)
+	for _, s := range []string{
+		"foo.docker. 0 IN A 127.0.0.1",
+		"foo.docker. 0 IN AAAA ::1",
+		"foo.docker. 0 IN A 127.0.0.2",
+		"foo.example. 0 IN A 127.0.0.3",
+	} {
+		rr, _ := dns.NewRR(s)
+		rrs = append(rrs, rr)
+	}
+
+	// the records of a RRset are signed together even if they are not adjacent
+	res := server.signSection(rrs)
+	keys := map[uint16]*dns.DNSKEY{server.signer.zsk.key.KeyTag(): server.signer.zsk.key}
+	verifySection(t, res[:5], keys)
+
+	sigs := 0
+	for _, rr := range res {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			sigs++
+		}
+	}
+	if len(res) != 6 || sigs != 2 {
+		t.Error("Expected the records and a signature per RRset of the zone Got:", res)
+	}
+}
@@ -12,9 +12,14 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aacebedo/dnsdock/internal/utils"
@@ -25,26 +30,143 @@ import (
 type Service struct {
 	Name    string
 	Image   string
-	IPs     []net.IP
+	IPs     []Address
 	TTL     int
 	Aliases []string
+	Ports   []Port `json:",omitempty"`
+	// Records holds user defined resource records in zone file syntax, their
+	// owner names are relative to the name of the service
+	Records []string `json:",omitempty"`
+	// CNAME makes the names of the service an alias of another name, no other
+	// record is answered for the service when it is set
+	CNAME string `json:",omitempty"`
+	// MX is the mail exchange of the service, no MX record is answered if it is nil
+	MX *MailExchange `json:",omitempty"`
+
+	// Metadata describes the origin of the service (container ID, image...)
+	Metadata map[string]string `json:",omitempty"`
+	// Labels holds the labels of the container of the service, they are not
+	// exposed by the HTTP server since they may hold secrets
+	Labels map[string]string `json:"-"`
 
 	// Provider tracks the creator of a service
 	Provider string `json:"-"`
 }
 
+// MailExchange describes the MX record of a service. The exchange defaults to
+// the name of the service.
+type MailExchange struct {
+	Preference uint16
+	Exchange   string `json:",omitempty"`
+}
+
 // NewService creates a new service
 func NewService(provider string) (s *Service) {
 	s = &Service{TTL: -1, Provider: provider}
 	return
 }
+
+// networkIPs returns the addresses of the service on the given network
+func (s *Service) networkIPs(network string) []net.IP {
+	ips := make([]net.IP, 0, len(s.IPs))
+	for _, addr := range s.IPs {
+		if addr.Network == network {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips
+}
+
+// sortedNetworks returns the names of the networks of the service in a stable order
+func (s *Service) sortedNetworks() []string {
+	networks := make([]string, 0, len(s.IPs))
+	for _, addr := range s.IPs {
+		if len(addr.Network) > 0 && !slices.Contains(networks, addr.Network) {
+			networks = append(networks, addr.Network)
+		}
+	}
+	sort.Strings(networks)
+	return networks
+}
+
 func (s Service) String() string {
 	return fmt.Sprintf(` Name:     %s
                        Aliases:  %s
                        IPs:      %s
+                       Ports:    %s
                        TTL:      %d
                        Provider: %s
-        `, s.Name, s.Aliases, s.IPs, s.TTL, s.Provider)
+        `, s.Name, s.Aliases, s.IPs, s.Ports, s.TTL, s.Provider)
+}
+
+// serviceMatch is a service matching a DNS query. The network is set when the
+// query targets the addresses of the service on a single network.
+type serviceMatch struct {
+	service *Service
+	network string
+}
+
+// ips returns the addresses answered for the match to the given client.
+// Unless the query targets a single network, the addresses of the family of
+// the client sharing a network with it are preferred, followed by the
+// addresses of the other family. When there is none, all the addresses are
+// returned sorted according to the configured network order.
+func (m *serviceMatch) ips(client net.IP, networkOrder []string) []net.IP {
+	if len(m.network) > 0 {
+		return m.service.networkIPs(m.network)
+	}
+
+	addrs := slices.Clone(m.service.IPs)
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return networkRank(addrs[i].Network, networkOrder) < networkRank(addrs[j].Network, networkOrder)
+	})
+
+	ips := make([]net.IP, 0, len(addrs))
+	if client != nil {
+		ipv4 := client.To4() != nil
+
+		// select the networks sharing a subnet with the client, addresses
+		// without a network are selected on their own subnet
+		networks := make([]string, 0)
+		for _, addr := range m.service.IPs {
+			if addr.Contains(client) {
+				if len(addr.Network) == 0 {
+					ips = append(ips, addr.IP)
+				} else if !slices.Contains(networks, addr.Network) {
+					networks = append(networks, addr.Network)
+				}
+			}
+		}
+		for _, addr := range m.service.IPs {
+			if len(addr.Network) > 0 && slices.Contains(networks, addr.Network) && (addr.IP.To4() != nil) == ipv4 {
+				ips = append(ips, addr.IP)
+			}
+		}
+
+		// the subnets of the client say nothing about the other family
+		if len(ips) > 0 {
+			for _, addr := range addrs {
+				if (addr.IP.To4() != nil) != ipv4 {
+					ips = append(ips, addr.IP)
+				}
+			}
+			return ips
+		}
+	}
+
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
+
+// networkRank returns the position of a network in the configured order,
+// networks which are not listed come last
+func networkRank(network string, networkOrder []string) int {
+	if i := slices.Index(networkOrder, network); i != -1 {
+		return i
+	}
+	return len(networkOrder)
 }
 
 // ServiceListProvider represents the entrypoint to get containers
@@ -55,13 +177,55 @@ type ServiceListProvider interface {
 	GetAllServices() map[string]Service
 }
 
+// Stats holds the counters of the DNSServer
+type Stats struct {
+	Cache CacheStats
+	// Upstreams holds the counters of the nameservers by address
+	Upstreams map[string]UpstreamStats
+	Access    AccessStats
+}
+
+// StatsProvider represents the entrypoint to get the counters of the server
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// listener is a server started and stopped along with the DNSServer
+type listener interface {
+	ListenAndServe() error
+	Shutdown() error
+}
+
 // DNSServer represents a DNS server
 type DNSServer struct {
 	config   *utils.Config
-	server   *dns.Server
+	servers  []listener
+	certs    []*certReloader
 	mux      *dns.ServeMux
 	services map[string]*Service
-	lock     *sync.RWMutex
+	records  map[string][]dns.RR
+	signer   *signer
+	xfrAllow []*net.IPNet
+	nsIPs    []net.IP
+	exporter *exporter
+	cache    *forwardCache
+	// upstreams holds the nameservers of the forwarded queries
+	upstreams *upstreamPool
+	// forwardRules maps domains to the nameservers of their queries
+	forwardRules map[string][]string
+	// resolv holds the settings of the resolv.conf file
+	resolv *resolvConf
+	// zoneAccess and recursionAccess list the clients allowed to query the
+	// zone and to have their queries forwarded
+	zoneAccess      *accessList
+	recursionAccess *accessList
+	// serial is the serial of the zone, increased on every change
+	serial atomic.Uint32
+	// updateLock serializes the dynamic updates
+	updateLock sync.Mutex
+	// notifyTimer delays the NOTIFY messages sent to the secondaries
+	notifyTimer *time.Timer
+	lock        *sync.RWMutex
 }
 
 // NewDNSServer create a new DNSServer
@@ -69,34 +233,203 @@ func NewDNSServer(c *utils.Config) *DNSServer {
 	s := &DNSServer{
 		config:   c,
 		services: make(map[string]*Service),
+		records:  make(map[string][]dns.RR),
+		xfrAllow: parseNetworks(c.XfrAllow),
+		cache:    newForwardCache(c),
 		lock:     &sync.RWMutex{},
 	}
+	s.upstreams = newUpstreamPool(c)
+	s.zoneAccess = newAccessList("zone", c.ZoneAllow)
+	s.recursionAccess = newAccessList("recursion", c.RecursionAllow)
+	logger.Infof("Forwarding the queries of the clients of %s", strings.Join(c.RecursionAllow, " "))
+	if s.recursionAccess.open() {
+		logger.Warningf("The queries of any client are forwarded to the nameservers, dnsdock is an open resolver")
+	}
+
+	s.forwardRules = make(map[string][]string, len(c.ForwardRules))
+	for domain, nameservers := range c.ForwardRules {
+		if err := s.SetForwardRule(domain, nameservers); err != nil {
+			logger.Errorf("Invalid forwarding rule: %s", err)
+		}
+	}
 
 	logger.Debugf("Handling DNS requests for '%s'.", c.Domain.String())
 
+	// the serial starts from the current time to keep increasing across
+	// restarts
+	s.serial.Store(uint32(time.Now().Unix()))
+	s.nsIPs = nameServerIPs(c)
+
 	s.mux = dns.NewServeMux()
 	s.mux.HandleFunc(c.Domain.String()+".", s.handleRequest)
 	s.mux.HandleFunc("in-addr.arpa.", s.handleReverseRequest)
+	s.mux.HandleFunc("ip6.arpa.", s.handleReverseRequest)
 	s.mux.HandleFunc(".", s.handleForward)
 
-	s.server = &dns.Server{Addr: c.DnsAddr, Net: "udp", Handler: s.mux}
+	if c.Dnssec {
+		signer, err := newSigner(c.Domain.String()+".", c.DnssecKeyDir)
+		if err != nil {
+			logger.Errorf("Unable to load the DNSSEC keys: %s", err)
+		}
+		s.signer = signer
+	}
+
+	// answers which do not fit in UDP messages are retried over TCP
+	s.servers = []listener{
+		&dns.Server{Addr: c.DnsAddr, Net: "udp", Handler: s, UDPSize: c.EdnsMaxUDPSize, TsigSecret: c.TsigKeys, MsgAcceptFunc: acceptMsg},
+		&dns.Server{Addr: c.DnsAddr, Net: "tcp", Handler: s, TsigSecret: c.TsigKeys, MsgAcceptFunc: acceptMsg},
+	}
+
+	if len(c.DotCert) > 0 && len(c.DotKey) > 0 {
+		cert := newCertReloader(c.DotCert, c.DotKey)
+		s.certs = append(s.certs, cert)
+		s.servers = append(s.servers, &dns.Server{Addr: c.DotAddr, Net: "tcp-tls", Handler: s, TLSConfig: cert.tlsConfig("dot"), TsigSecret: c.TsigKeys, MsgAcceptFunc: acceptMsg})
+	}
+
+	if len(c.DoqCert) > 0 && len(c.DoqKey) > 0 {
+		cert := newCertReloader(c.DoqCert, c.DoqKey)
+		s.certs = append(s.certs, cert)
+		s.servers = append(s.servers, &doqServer{addr: c.DoqAddr, timeout: c.DoqIdleTimeout, tlsConfig: cert.tlsConfig("doq"), handler: s})
+	}
+
+	s.servers = append(s.servers, s.upstreams)
+
+	if len(c.ResolvConf) > 0 {
+		watcher := newResolvWatcher(s, c.ResolvConf)
+		if err := watcher.load(); err != nil {
+			logger.Errorf("Unable to read '%s': %s", c.ResolvConf, err)
+		}
+		s.servers = append(s.servers, watcher)
+	}
+	s.upstreams.setNameservers(s.allNameservers())
+
+	if len(c.ExportAddr) > 0 {
+		s.exporter = newExporter(s)
+		s.servers = append(s.servers, s.exporter)
+	}
+
+	if len(c.DohAddr) > 0 {
+		router := http.NewServeMux()
+		router.Handle(DoHPath, &dohHandler{handler: s})
+		server := &http.Server{Addr: c.DohAddr, Handler: router}
+		if len(c.DohCert) > 0 && len(c.DohKey) > 0 {
+			cert := newCertReloader(c.DohCert, c.DohKey)
+			s.certs = append(s.certs, cert)
+			server.TLSConfig = cert.tlsConfig("h2", "http/1.1")
+		}
+		s.servers = append(s.servers, &httpListener{server: server})
+	}
 
 	return s
 }
 
-// Start starts the DNSServer
+// ServeDNS checks the requests before dispatching them to the handlers
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if !s.checkEdns0(w, r) || !s.checkTsig(w, r) {
+		return
+	}
+	if r.Opcode == dns.OpcodeUpdate {
+		s.handleUpdate(w, r)
+		return
+	}
+	s.mux.ServeDNS(w, r)
+}
+
+// Start starts the DNSServer listeners and blocks until they are stopped. If
+// a listener fails, the others are stopped.
 func (s *DNSServer) Start() error {
-	return s.server.ListenAndServe()
+	if s.config.Dnssec && s.signer == nil {
+		return errors.New("DNSSEC keys are not available")
+	}
+
+	for _, cert := range s.certs {
+		if err := cert.reload(); err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, len(s.servers))
+	for _, server := range s.servers {
+		go func(server listener) {
+			errs <- server.ListenAndServe()
+		}(server)
+	}
+
+	for range s.servers {
+		if err := <-errs; err != nil {
+			s.Stop() //nolint:errcheck
+			return err
+		}
+	}
+	return nil
 }
 
-// Stop stops the DNSServer
+// Stop stops the DNSServer listeners
 func (s *DNSServer) Stop() error {
-	return s.server.Shutdown()
+	errs := make([]error, 0, len(s.servers))
+	for _, server := range s.servers {
+		errs = append(errs, server.Shutdown())
+	}
+	return errors.Join(errs...)
+}
+
+// writeMsg writes a response to the client. The OPT record of EDNS0 clients is
+// echoed in the response. UDP responses which do not fit in the buffer of the
+// client (512 bytes or the size advertised with EDNS0 capped by the server
+// maximum) are truncated, the client is expected to retry over TCP.
+func (s *DNSServer) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = min(max(int(opt.UDPSize()), dns.MinMsgSize), s.config.EdnsMaxUDPSize)
+
+		if res := m.IsEdns0(); res != nil {
+			res.SetUDPSize(uint16(s.config.EdnsMaxUDPSize))
+		} else {
+			m.SetEdns0(uint16(s.config.EdnsMaxUDPSize), opt.Do())
+		}
+	}
+
+	// the response is truncated before it is signed since signed messages
+	// cannot be truncated, with room left for the TSIG record
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		truncateSigned(m, size, s.tsigLen(w, r))
+	} else {
+		m.Compress = true
+	}
+
+	s.signTsig(w, r, m)
+
+	res := w.WriteMsg(m)
+	if res != nil {
+		logger.Errorf("Unable to write response: '%s' ", res)
+	}
+}
+
+// checkEdns0 answers the requests using an unsupported EDNS version with
+// BADVERS as per RFC 6891 sec. 6.1.3. It returns false if the request must not
+// be processed further.
+func (s *DNSServer) checkEdns0(w dns.ResponseWriter, r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil || opt.Version() == 0 {
+		return true
+	}
+
+	logger.Debugf("Unsupported EDNS version %d from remote '%s'", opt.Version(), w.RemoteAddr())
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.SetEdns0(uint16(s.config.EdnsMaxUDPSize), opt.Do())
+	m.SetRcode(r, dns.RcodeBadVers)
+	res := w.WriteMsg(m)
+	if res != nil {
+		logger.Errorf("Unable to write response: '%s' ", res)
+	}
+	return false
 }
 
 // AddService adds a new container and thus new DNS records
 func (s *DNSServer) AddService(id string, service Service) (err error) {
-	if len(service.IPs) > 0 {
+	if len(service.IPs) > 0 || len(service.CNAME) > 0 || len(service.Records) > 0 {
 		defer s.lock.Unlock()
 		s.lock.Lock()
 
@@ -106,6 +439,8 @@ func (s *DNSServer) AddService(id string, service Service) (err error) {
 		}
 
 		s.services[id] = &service
+		s.records[id] = s.parseServiceRecords(&service)
+		s.zoneChanged()
 
 		logger.Debugf(`Added service: '%s'
                       %s`, id, service)
@@ -139,6 +474,8 @@ func (s *DNSServer) RemoveService(id string) (err error) {
 	}
 
 	delete(s.services, id)
+	delete(s.records, id)
+	s.zoneChanged()
 
 	logger.Debugf("Removed service '%s'", id)
 
@@ -161,6 +498,11 @@ func (s *DNSServer) GetService(id string) (Service, error) {
 	return *new(Service), errors.New("No such service: " + id)
 }
 
+// Stats returns the counters of the server
+func (s *DNSServer) Stats() Stats {
+	return Stats{Cache: s.cache.stats(), Upstreams: s.upstreams.stats(), Access: s.accessStats()}
+}
+
 // GetAllServices reads all services from the repository
 func (s *DNSServer) GetAllServices() map[string]Service {
 	defer s.lock.RUnlock()
@@ -199,129 +541,212 @@ func (s *DNSServer) listDomains(service *Service) chan string {
 }
 
 func (s *DNSServer) handleForward(w dns.ResponseWriter, r *dns.Msg) {
+	if !s.checkAccess(w, r, s.recursionAccess) {
+		return
+	}
 
 	logger.Debugf("Using DNS forwarding for '%s'", r.Question[0].Name)
-	logger.Debugf("Forwarding DNS nameservers: %s", s.config.Nameservers.String())
 
-	// Otherwise just forward the request to another server
-	c := new(dns.Client)
+	in, err := s.forward(r)
+	if err != nil {
+		logger.Warningf("DNS fowarding failed: %s", err)
 
-	// look at each Nameserver, stop on success
-	for i := range s.config.Nameservers {
-		logger.Debugf("Using Nameserver %s", s.config.Nameservers[i])
+		// Send failure reply
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Ns = s.createSOA()
+		m.SetRcode(r, dns.RcodeRefused) // REFUSED
+		s.writeMsg(w, r, m)
+		return
+	}
 
-		in, _, err := c.Exchange(r, s.config.Nameservers[i])
-		if err == nil {
-			if s.config.ForceTtl {
-				logger.Debugf("Forcing Ttl value of the forwarded response")
-				for _, rr := range in.Answer {
-					rr.Header().Ttl = uint32(s.config.Ttl)
-				}
-			}
+	s.writeMsg(w, r, in)
+}
 
-			res := w.WriteMsg(in)
-			if res != nil {
-				logger.Errorf("Unable to write response: '%s' ", res)
+// forward answers a query from the cache or sends it to the nameservers. A
+// stale cached answer is returned when none of the nameservers answers.
+func (s *DNSServer) forward(r *dns.Msg) (*dns.Msg, error) {
+	in := s.cache.get(r)
+	if in != nil {
+		logger.Debugf("Cached response found for '%s'", r.Question[0].Name)
+	} else {
+		var err error
+		in, err = s.exchange(r)
+		if err != nil {
+			if in = s.cache.getStale(r); in == nil {
+				return nil, err
 			}
-			return
+			logger.Warningf("DNS forwarding failed, serving a stale response for '%s'", r.Question[0].Name)
+		} else {
+			s.cache.set(r, in)
 		}
+	}
 
-		if i == (len(s.config.Nameservers) - 1) {
-			logger.Warningf("DNS fowarding failed: no more nameservers to try")
-
-			// Send failure reply
-			m := new(dns.Msg)
-			m.SetReply(r)
-			m.Ns = s.createSOA()
-			m.SetRcode(r, dns.RcodeRefused) // REFUSED
-			res := w.WriteMsg(m)
-			if res != nil {
-				logger.Errorf("Unable to write response: '%s' ", res)
-			}
-
-		} else {
-			logger.Debugf("DNS fowarding failed: trying next Nameserver...")
+	if s.config.ForceTtl {
+		logger.Debugf("Forcing Ttl value of the forwarded response")
+		for _, rr := range in.Answer {
+			rr.Header().Ttl = uint32(s.config.Ttl)
 		}
 	}
+	return in, nil
 }
 
-func (s *DNSServer) makeServiceA(n string, service *Service) dns.RR {
-	rr := new(dns.A)
+// exchange sends a query to the nameservers and returns the first answer. The
+// names built with the search domains of resolv.conf are tried first, the
+// answer for such a name is returned as is with the question of the query, no
+// record is added to it.
+func (s *DNSServer) exchange(r *dns.Msg) (*dns.Msg, error) {
+	name := r.Question[0].Name
+	for _, expanded := range s.searchNames(name) {
+		m := r.Copy()
+		m.Question[0].Name = expanded
+		in, err := s.exchangeName(m)
+		if err != nil || in.Rcode != dns.RcodeSuccess || len(in.Answer) == 0 {
+			continue
+		}
 
-	var ttl int
-	if service.TTL != -1 {
-		ttl = service.TTL
-	} else {
-		ttl = s.config.Ttl
+		logger.Debugf("Name '%s' found as '%s' with the search domains", name, expanded)
+		in.Question = r.Question
+		return in, nil
 	}
 
-	rr.Hdr = dns.RR_Header{
-		Name:   n,
-		Rrtype: dns.TypeA,
-		Class:  dns.ClassINET,
-		Ttl:    uint32(ttl),
-	}
+	return s.exchangeName(r)
+}
+
+// exchangeName sends a query to the nameservers of its name and returns the
+// first answer
+func (s *DNSServer) exchangeName(r *dns.Msg) (*dns.Msg, error) {
+	nameservers := s.forwardNameservers(r.Question[0].Name)
+	logger.Debugf("Forwarding DNS nameservers: %s", strings.Join(nameservers, " "))
+
+	return s.upstreams.exchange(r, nameservers)
+}
 
-	if len(service.IPs) != 0 {
-		if len(service.IPs) > 1 {
-			logger.Warningf("Multiple IP address found for container '%s'. Only the first address will be used", service.Name)
+func (s *DNSServer) makeServiceA(n string, match *serviceMatch, client net.IP) []dns.RR {
+	ips := filterIPv4(match.ips(client, s.config.NetworkOrder))
+	rrs := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		rr := new(dns.A)
+		rr.Hdr = dns.RR_Header{
+			Name:   n,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(s.getTTL(match.service)),
 		}
-		rr.A = service.IPs[0]
-	} else {
-		logger.Errorf("No valid IP address found for container '%s' ", service.Name)
+		rr.A = ip
+
+		rrs = append(rrs, rr)
 	}
 
-	return rr
+	return rrs
 }
 
-func (s *DNSServer) makeServiceMX(n string, service *Service) dns.RR {
-	rr := new(dns.MX)
+func (s *DNSServer) makeServiceAAAA(n string, match *serviceMatch, client net.IP) []dns.RR {
+	ips := filterIPv6(match.ips(client, s.config.NetworkOrder))
+	rrs := make([]dns.RR, 0, len(ips))
+	for _, ip := range ips {
+		rr := new(dns.AAAA)
+		rr.Hdr = dns.RR_Header{
+			Name:   n,
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(s.getTTL(match.service)),
+		}
+		rr.AAAA = ip
 
-	var ttl int
-	if service.TTL != -1 {
-		ttl = service.TTL
-	} else {
-		ttl = s.config.Ttl
+		rrs = append(rrs, rr)
 	}
 
+	return rrs
+}
+
+func (s *DNSServer) makeServiceMX(n string, match *serviceMatch) dns.RR {
+	service := match.service
+
+	var preference uint16
+	var exchange string
+	switch {
+	case service.MX != nil:
+		preference = service.MX.Preference
+		exchange = service.MX.Exchange
+		if len(exchange) == 0 {
+			exchange = s.serviceName(match)
+		}
+	case s.config.LegacyMX:
+		// legacy behaviour: every service is its own mail exchange
+		exchange = n
+	default:
+		return nil
+	}
+
+	rr := new(dns.MX)
+
 	rr.Hdr = dns.RR_Header{
 		Name:   n,
 		Rrtype: dns.TypeMX,
 		Class:  dns.ClassINET,
-		Ttl:    uint32(ttl),
+		Ttl:    uint32(s.getTTL(service)),
 	}
 
-	rr.Mx = n
+	rr.Preference = preference
+	rr.Mx = dns.Fqdn(exchange)
 
 	return rr
 }
 
+// lookupAddresses returns the A and AAAA records of a name of the domain, it
+// must not be called while iterating over services
+func (s *DNSServer) lookupAddresses(name string, client net.IP) []dns.RR {
+	rrs := make([]dns.RR, 0)
+	for match := range s.queryServices(strings.TrimSuffix(name, ".")) {
+		rrs = append(rrs, s.makeServiceA(name, match, client)...)
+		rrs = append(rrs, s.makeServiceAAAA(name, match, client)...)
+	}
+	return rrs
+}
+
 func (s *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if !s.checkAccess(w, r, s.zoneAccess) {
+		return
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.RecursionAvailable = true
+	m.RecursionAvailable = s.recursionAccess.contains(remoteIP(w.RemoteAddr()))
 
 	// Send empty response for empty requests
 	if len(r.Question) == 0 {
 		m.Ns = s.createSOA()
-		res := w.WriteMsg(m)
-		if res != nil {
-			logger.Errorf("Unable to write response: '%s' ", res)
-		}
+		s.writeMsg(w, r, m)
 		return
 	}
 
 	// respond to SOA requests
 	if r.Question[0].Qtype == dns.TypeSOA {
 		m.Answer = s.createSOA()
-		res := w.WriteMsg(m)
-		if res != nil {
-			logger.Errorf("Unable to write response: '%s' ", res)
+		if s.doDNSSEC(r) {
+			s.signMsg(m)
 		}
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	// respond to zone transfer requests
+	if r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR {
+		s.handleTransfer(w, r)
+		return
+	}
+
+	// respond to DNSKEY requests at the apex of the zone
+	if r.Question[0].Qtype == dns.TypeDNSKEY && s.signer != nil && strings.EqualFold(r.Question[0].Name, s.config.Domain.String()+".") {
+		m.Answer = s.signer.dnskeys(r.Question[0].Name, uint32(s.config.Ttl))
+		if s.doDNSSEC(r) {
+			s.signMsg(m)
+		}
+		s.writeMsg(w, r, m)
 		return
 	}
 
-	m.Answer = make([]dns.RR, 0, 2)
 	query := r.Question[0].Name
 
 	// trim off any trailing dot
@@ -331,56 +756,171 @@ func (s *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 
 	logger.Debugf("DNS request for query '%s' from remote '%s'", query, w.RemoteAddr())
 
-	for service := range s.queryServices(query) {
-		var rr dns.RR
-		switch r.Question[0].Qtype {
+	client := remoteIP(w.RemoteAddr())
+	answer, extra, found := s.answer(r.Question[0].Name, r.Question[0].Qtype, client)
+	m.Answer = answer
+	m.Extra = extra
+
+	rcode := dns.RcodeSuccess
+	if !found {
+		rcode = dns.RcodeNameError
+	}
+
+	// follow the CNAME records to answer with the records of the target
+	if len(answer) > 0 && answer[len(answer)-1].Header().Rrtype == dns.TypeCNAME && r.Question[0].Qtype != dns.TypeCNAME {
+		var chain []dns.RR
+		chain, rcode = s.chaseCNAME(r, answer[len(answer)-1].(*dns.CNAME), client)
+		m.Answer = append(m.Answer, chain...)
+	}
+
+	// the denied name is the target of the CNAME chain if any
+	denied := r.Question[0].Name
+	if len(m.Answer) > 0 {
+		if cname, ok := m.Answer[len(m.Answer)-1].(*dns.CNAME); ok {
+			denied = cname.Target
+		}
+	}
+	signed := s.doDNSSEC(r) && len(s.signerZone(denied)) > 0
+
+	if rcode == dns.RcodeNameError {
+		// We didn't find a record corresponding to the query
+		m.Ns = s.createSOA()
+		if signed {
+			// signed responses deny the name with a NSEC record instead
+			m.Ns = append(m.Ns, s.makeDenial(denied, nil))
+		} else {
+			m.SetRcode(r, dns.RcodeNameError) // NXDOMAIN
+		}
+		logger.Debugf("No DNS record found for query '%s'", query)
+	} else if rcode != dns.RcodeSuccess {
+		m.SetRcode(r, rcode)
+	} else if len(m.Answer) == 0 {
+		// The name exists but not with the requested type
+		m.Ns = s.createSOA()
+		m.MsgHdr.Authoritative = true
+		if signed {
+			m.Ns = append(m.Ns, s.makeDenial(denied, s.typesAt(denied, client)))
+		}
+		logger.Debugf("No DNS record of type %s found for query '%s'", dns.TypeToString[r.Question[0].Qtype], query)
+	}
+
+	if s.doDNSSEC(r) {
+		s.signMsg(m)
+	}
+	s.writeMsg(w, r, m)
+}
+
+// answer returns the records answering a query for a name of the domain and
+// the records to add in the additional section. found is false when the name
+// does not exist. A CNAME record is returned alone when the name is an alias
+// of another name.
+func (s *DNSServer) answer(qname string, qtype uint16, client net.IP) (answer []dns.RR, extra []dns.RR, found bool) {
+	query := strings.TrimSuffix(qname, ".")
+	answer = make([]dns.RR, 0, 2)
+
+	// SRV queries are prefixed with the service name and the protocol
+	name := query
+	var srvName, srvProto string
+	if qtype == dns.TypeSRV {
+		srvName, srvProto, name = splitSRVQuery(query)
+	}
+
+	// the name servers of the zone and their addresses
+	answer, extra = s.makeZoneNS(qname, qtype)
+
+	// user defined records come first, a CNAME record excludes any other record
+	records := s.queryRecords(query)
+	answer = append(answer, filterRecords(records, qtype)...)
+	if len(answer) > 0 && answer[0].Header().Rrtype == dns.TypeCNAME && qtype != dns.TypeCNAME {
+		return answer[:1], nil, true
+	}
+
+	matches := make([]*serviceMatch, 0)
+	aliases := make([]*serviceMatch, 0)
+	for match := range s.queryServices(name) {
+		if len(match.service.CNAME) > 0 {
+			aliases = append(aliases, match)
+		} else {
+			matches = append(matches, match)
+		}
+	}
+
+	// the name is an alias only if no other service matches it
+	if len(records) == 0 && len(matches) == 0 && len(aliases) > 0 {
+		if len(aliases) > 1 {
+			logger.Warningf("Multiple CNAME found for query '%s'. Only the first one will be used", query)
+		}
+		return []dns.RR{s.makeServiceCNAME(qname, aliases[0].service)}, nil, true
+	}
+
+	found = len(records) > 0 || len(matches) > 0 || s.isZoneName(qname)
+	for _, match := range matches {
+		var rrs []dns.RR
+		switch qtype {
 		case dns.TypeA:
-			rr = s.makeServiceA(r.Question[0].Name, service)
+			rrs = s.makeServiceA(qname, match, client)
+		case dns.TypeAAAA:
+			rrs = s.makeServiceAAAA(qname, match, client)
 		case dns.TypeMX:
-			rr = s.makeServiceMX(r.Question[0].Name, service)
+			if rr := s.makeServiceMX(qname, match); rr != nil {
+				rrs = []dns.RR{rr}
+				// add the addresses of the exchange if it is a name of the domain
+				if dns.IsSubDomain(s.config.Domain.String()+".", rr.(*dns.MX).Mx) {
+					extra = append(extra, s.lookupAddresses(rr.(*dns.MX).Mx, client)...)
+				}
+			}
+		case dns.TypeTXT:
+			rrs = s.makeServiceTXT(qname, match.service)
+		case dns.TypeSRV:
+			var glue []dns.RR
+			rrs, glue = s.makeServiceSRV(qname, match, srvName, srvProto, client)
+			extra = append(extra, glue...)
 		default:
 			// this query type isn't supported, but we do have
 			// a record with this name. Per RFC 4074 sec. 3, we
-			// immediately return an empty NOERROR reply.
-			m.Ns = s.createSOA()
-			m.MsgHdr.Authoritative = true
-			res := w.WriteMsg(m)
-			if res != nil {
-				logger.Errorf("Unable to write response: '%s' ", res)
-			}
-			return
+			// return an empty NOERROR reply.
+			continue
+		}
+
+		// the service exists but has no address of the requested family
+		if len(rrs) == 0 {
+			continue
 		}
 
 		logger.Debugf("DNS record found for query '%s'", query)
 
-		m.Answer = append(m.Answer, rr)
+		answer = append(answer, rrs...)
 	}
 
-	// We didn't find a record corresponding to the query
-	if len(m.Answer) == 0 {
-		m.Ns = s.createSOA()
-		m.SetRcode(r, dns.RcodeNameError) // NXDOMAIN
-		logger.Debugf("No DNS record found for query '%s'", query)
-	}
+	// targets shared by several records are only added once
+	extra = dns.Dedup(extra, nil)
 
-	res := w.WriteMsg(m)
-	if res != nil {
-		logger.Errorf("Unable to write response: '%s' ", res)
-	}
+	return
 }
 
 func (s *DNSServer) handleReverseRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if !s.checkAccess(w, r, s.zoneAccess) {
+		return
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.RecursionAvailable = true
+	m.RecursionAvailable = s.recursionAccess.contains(remoteIP(w.RemoteAddr()))
 
 	// Send empty response for empty requests
 	if len(r.Question) == 0 {
 		m.Ns = s.createSOA()
-		res := w.WriteMsg(m)
-		if res != nil {
-			logger.Errorf("Unable to write response: '%s' ", res)
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	// respond to DNSKEY requests at the apex of the reverse zones
+	if r.Question[0].Qtype == dns.TypeDNSKEY && s.signer != nil && s.signerZone(r.Question[0].Name) == strings.ToLower(r.Question[0].Name) {
+		m.Answer = s.signer.dnskeys(r.Question[0].Name, uint32(s.config.Ttl))
+		if s.doDNSSEC(r) {
+			s.signMsg(m)
 		}
+		s.writeMsg(w, r, m)
 		return
 	}
 
@@ -395,27 +935,21 @@ func (s *DNSServer) handleReverseRequest(w dns.ResponseWriter, r *dns.Msg) {
 	for service := range s.queryIP(query) {
 		if r.Question[0].Qtype != dns.TypePTR {
 			m.Ns = s.createSOA()
-			res := w.WriteMsg(m)
-			if res != nil {
-				logger.Errorf("Unable to write response: '%s' ", res)
+			if s.doDNSSEC(r) {
+				m.Ns = append(m.Ns, s.makeDenial(r.Question[0].Name, []uint16{dns.TypePTR}))
+				s.signMsg(m)
 			}
+			s.writeMsg(w, r, m)
 			return
 		}
 
-		var ttl int
-		if service.TTL != -1 {
-			ttl = service.TTL
-		} else {
-			ttl = s.config.Ttl
-		}
-
 		for domain := range s.listDomains(service) {
 			rr := new(dns.PTR)
 			rr.Hdr = dns.RR_Header{
 				Name:   r.Question[0].Name,
 				Rrtype: dns.TypePTR,
 				Class:  dns.ClassINET,
-				Ttl:    uint32(ttl),
+				Ttl:    uint32(s.getTTL(service)),
 			}
 			rr.Ptr = domain
 
@@ -424,10 +958,10 @@ func (s *DNSServer) handleReverseRequest(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	if len(m.Answer) != 0 {
-		res := w.WriteMsg(m)
-		if res != nil {
-			logger.Errorf("Unable to write response: '%s' ", res)
+		if s.doDNSSEC(r) {
+			s.signMsg(m)
 		}
+		s.writeMsg(w, r, m)
 
 	} else {
 		// We didn't find a record corresponding to the query,
@@ -438,16 +972,20 @@ func (s *DNSServer) handleReverseRequest(w dns.ResponseWriter, r *dns.Msg) {
 
 func (s *DNSServer) queryIP(query string) chan *Service {
 	c := make(chan *Service, 3)
-	reversedIP := strings.TrimSuffix(query, ".in-addr.arpa")
-	ip := strings.Join(reverse(strings.Split(reversedIP, ".")), ".")
+	ip := reverseToIP(query)
 
 	go func() {
 		defer s.lock.RUnlock()
 		s.lock.RLock()
 
-		for _, service := range s.services {
-			if service.IPs[0].String() == ip {
-				c <- service
+		if ip != nil {
+			for _, service := range s.services {
+				for _, addr := range service.IPs {
+					if addr.IP.Equal(ip) {
+						c <- service
+						break
+					}
+				}
 			}
 		}
 
@@ -457,8 +995,8 @@ func (s *DNSServer) queryIP(query string) chan *Service {
 	return c
 }
 
-func (s *DNSServer) queryServices(query string) chan *Service {
-	c := make(chan *Service, 3)
+func (s *DNSServer) queryServices(query string) chan *serviceMatch {
+	c := make(chan *serviceMatch, 3)
 
 	go func() {
 		query := strings.Split(strings.ToLower(query), ".")
@@ -468,12 +1006,13 @@ func (s *DNSServer) queryServices(query string) chan *Service {
 
 		for _, service := range s.services {
 			// create the name for this service, skip empty strings
-			test := []string{}
+			name := []string{}
 			// todo: add some cache to avoid calculating this every time
 			if len(service.Name) > 0 {
-				test = append(test, strings.Split(strings.ToLower(service.Name), ".")...)
+				name = append(name, strings.Split(strings.ToLower(service.Name), ".")...)
 			}
 
+			test := append([]string{}, name...)
 			if len(service.Image) > 0 {
 				test = append(test, strings.Split(service.Image, ".")...)
 			}
@@ -481,13 +1020,23 @@ func (s *DNSServer) queryServices(query string) chan *Service {
 			test = append(test, s.config.Domain...)
 
 			if isPrefixQuery(query, test) {
-				c <- service
+				c <- &serviceMatch{service: service}
+			} else {
+				// check the per network names: <name>.<network>.<domain>
+				for _, network := range service.sortedNetworks() {
+					test := append(append([]string{}, name...), strings.Split(strings.ToLower(network), ".")...)
+					test = append(test, s.config.Domain...)
+					if isPrefixQuery(query, test) {
+						c <- &serviceMatch{service: service, network: network}
+						break
+					}
+				}
 			}
 
 			// check aliases
 			for _, alias := range service.Aliases {
 				if isPrefixQuery(query, strings.Split(alias, ".")) {
-					c <- service
+					c <- &serviceMatch{service: service}
 				}
 			}
 		}
@@ -500,6 +1049,47 @@ func (s *DNSServer) queryServices(query string) chan *Service {
 
 }
 
+// filterIPv4 returns the IPv4 addresses of a list
+func filterIPv4(ips []net.IP) []net.IP {
+	res := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			res = append(res, ip4)
+		}
+	}
+	return res
+}
+
+// filterIPv6 returns the IPv6 addresses of a list
+func filterIPv6(ips []net.IP) []net.IP {
+	res := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() == nil && ip.To16() != nil {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
+
+// remoteIP returns the IP address of a remote peer, nil if it is unknown
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// getTTL returns the TTL of the records of a service
+func (s *DNSServer) getTTL(service *Service) int {
+	if service.TTL != -1 {
+		return service.TTL
+	}
+	return s.config.Ttl
+}
+
 // Checks for a partial match for container SHA and outputs it if found.
 func (s *DNSServer) getExpandedID(in string) (out string, err error) {
 	out = in
@@ -531,24 +1121,34 @@ func (s *DNSServer) getExpandedID(in string) (out string, err error) {
 	return
 }
 
-// TTL is used from config so that not-found result responses are not cached
-// for a long time. The other defaults left as is(skydns source) because they
-// do not have an use case in this situation.
+// negativeTTL returns the TTL of the negative answers. It defaults to the TTL
+// from config so that not-found result responses are not cached for a long
+// time.
+func (s *DNSServer) negativeTTL() int {
+	if s.config.SoaNegTtl == -1 {
+		return s.config.Ttl
+	}
+	return s.config.SoaNegTtl
+}
+
+// createSOA creates the SOA record of the zone, its minimum TTL is the
+// negative TTL. The serial is increased every time the zone changes.
 func (s *DNSServer) createSOA() []dns.RR {
 	dom := dns.Fqdn(s.config.Domain.String() + ".")
+	negTTL := s.negativeTTL()
 	soa := &dns.SOA{
 		Hdr: dns.RR_Header{
 			Name:   dom,
 			Rrtype: dns.TypeSOA,
 			Class:  dns.ClassINET,
-			Ttl:    uint32(s.config.Ttl)},
-		Ns:      "dnsdock." + dom,
-		Mbox:    "dnsdock.dnsdock." + dom,
-		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
-		Refresh: 28800,
-		Retry:   7200,
-		Expire:  604800,
-		Minttl:  uint32(s.config.Ttl),
+			Ttl:    uint32(negTTL)},
+		Ns:      s.nameServer(),
+		Mbox:    s.zoneName(strings.Replace(s.config.SoaRname, "@", ".", 1)),
+		Serial:  s.serial.Load(),
+		Refresh: uint32(s.config.SoaRefresh),
+		Retry:   uint32(s.config.SoaRetry),
+		Expire:  uint32(s.config.SoaExpire),
+		Minttl:  uint32(negTTL),
 	}
 	return []dns.RR{soa}
 }
@@ -572,6 +1172,47 @@ func isPrefixQuery(query, name []string) bool {
 	return true
 }
 
+// reverseToIP decodes a reverse lookup name (in-addr.arpa or ip6.arpa) to
+// the IP address it refers to. It returns nil if the name is not a complete
+// reverse name.
+// Examples:
+//
+//	4.3.2.1.in-addr.arpa                                                     is 1.2.3.4
+//	1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa is fd00::1
+func reverseToIP(query string) net.IP {
+	query = strings.ToLower(strings.TrimSuffix(query, "."))
+
+	if reversedIP, ok := strings.CutSuffix(query, ".in-addr.arpa"); ok {
+		return net.ParseIP(strings.Join(reverse(strings.Split(reversedIP, ".")), ".")).To4()
+	}
+
+	if reversedIP, ok := strings.CutSuffix(query, ".ip6.arpa"); ok {
+		nibbles := strings.Split(reversedIP, ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+
+		for _, nibble := range nibbles {
+			if len(nibble) != 1 {
+				return nil
+			}
+		}
+
+		hex := strings.Join(reverse(nibbles), "")
+		ip := make(net.IP, 0, net.IPv6len)
+		for i := 0; i < len(hex); i += 2 {
+			b, err := strconv.ParseUint(hex[i:i+2], 16, 8)
+			if err != nil {
+				return nil
+			}
+			ip = append(ip, byte(b))
+		}
+		return ip
+	}
+
+	return nil
+}
+
 func reverse(input []string) []string {
 	if len(input) == 0 {
 		return input
@@ -9,9 +9,12 @@
 package servers
 
 import (
+	"crypto/tls"
+	"fmt"
 	"github.com/aacebedo/dnsdock/internal/utils"
 	"github.com/miekg/dns"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -22,6 +25,8 @@ func TestDNSResponse(t *testing.T) {
 
 	config := utils.NewConfig()
 	config.DnsAddr = TestAddr
+	// every service answers MX queries
+	config.LegacyMX = true
 
 	server := NewDNSServer(config)
 	go server.Start() //nolint:errcheck
@@ -29,19 +34,19 @@ func TestDNSResponse(t *testing.T) {
 	// Allow some time for server to start
 	time.Sleep(250 * time.Millisecond)
 
-	res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
-	res = server.AddService("baz", Service{Name: "baz", Image: "bar", IPs: []net.IP{net.ParseIP("127.0.0.1")}, TTL: -1})
+	res = server.AddService("baz", Service{Name: "baz", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1")), TTL: -1})
   if res != nil {
     t.Error("Error adding service", res)
   }
-	res = server.AddService("biz", Service{Name: "hey", Image: "", IPs: []net.IP{net.ParseIP("127.0.0.4")}})
+	res = server.AddService("biz", Service{Name: "hey", Image: "", IPs: AddressesFromIPs(net.ParseIP("127.0.0.4"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
-	res = server.AddService("joe", Service{Name: "joe", Image: "", IPs: []net.IP{net.ParseIP("127.0.0.5")}, Aliases: []string{"lala.docker", "super-alias", "alias.domain"}})
+	res = server.AddService("joe", Service{Name: "joe", Image: "", IPs: AddressesFromIPs(net.ParseIP("127.0.0.5")), Aliases: []string{"lala.docker", "super-alias", "alias.domain"}})
   if res != nil {
     t.Error("Error adding service", res)
   }
@@ -119,6 +124,719 @@ func TestDNSResponse(t *testing.T) {
 	}
 }
 
+func TestDNSResponseIPv6(t *testing.T) {
+	const TestAddr = "127.0.0.1:9954"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	res := server.AddService("dual", Service{Name: "dual", Image: "stack", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"), net.ParseIP("fd00::1"))})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+	res = server.AddService("v6", Service{Name: "v6", Image: "only", IPs: AddressesFromIPs(net.ParseIP("fd00::2")), Aliases: []string{"six.alias"}})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	testDNSResponses(t, TestAddr, []dnsTestCase{
+		{"docker.", 1, "A", 0},
+		{"docker.", 2, "AAAA", 0},
+		{"*.docker.", 2, "AAAA", 0},
+		{"stack.docker.", 1, "A", 0},
+		{"stack.docker.", 1, "AAAA", 0},
+		{"dual.stack.docker.", 1, "AAAA", 0},
+		{"only.docker.", 0, "A", 0},
+		{"only.docker.", 1, "AAAA", 0},
+		{"six.alias.", 1, "AAAA", 0},
+		{"none.docker.", 0, "AAAA", dns.RcodeNameError},
+		{"1.0.0.127.in-addr.arpa.", 2, "PTR", 0}, // IPv4 address of a dual stack service
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", 2, "PTR", 0}, // IPv6 address of a dual stack service
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", 3, "PTR", 0}, // IPv6 only service with an alias
+	})
+}
+
+func TestDNSResponseNetworks(t *testing.T) {
+	const TestAddr = "127.0.0.1:9955"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	res := server.AddService("multi", Service{
+		Name:  "multi",
+		Image: "img",
+		IPs: []Address{
+			NewAddress(net.ParseIP("10.0.1.2"), "front", 24),
+			NewAddress(net.ParseIP("10.0.2.2"), "back", 24),
+			NewAddress(net.ParseIP("fd00::2"), "back", 64),
+		},
+	})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+	res = server.AddService("other", Service{
+		Name:  "other",
+		Image: "img",
+		IPs:   []Address{NewAddress(net.ParseIP("10.0.2.3"), "back", 24)},
+	})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+	res = server.AddService("local", Service{
+		Name:  "local",
+		Image: "img",
+		IPs: []Address{
+			NewAddress(net.ParseIP("10.0.1.4"), "front", 24),
+			NewAddress(net.ParseIP("127.0.0.4"), "loopback", 8),
+			NewAddress(net.ParseIP("fd00::4"), "loopback", 64),
+		},
+	})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	testDNSResponses(t, TestAddr, []dnsTestCase{
+		{"multi.img.docker.", 2, "A", 0},
+		{"multi.img.docker.", 1, "AAAA", 0},
+		{"local.img.docker.", 1, "A", 0},    // only the address sharing a subnet with the client
+		{"local.img.docker.", 1, "AAAA", 0}, // the address on the same network as the client
+		{"local.front.docker.", 1, "A", 0},
+		{"multi.front.docker.", 1, "A", 0},
+		{"multi.front.docker.", 0, "AAAA", 0},
+		{"multi.back.docker.", 1, "A", 0},
+		{"multi.back.docker.", 1, "AAAA", 0},
+		{"back.docker.", 2, "A", 0},
+		{"multi.none.docker.", 0, "A", dns.RcodeNameError},
+	})
+}
+
+func TestDNSResponseSRV(t *testing.T) {
+	const TestAddr = "127.0.0.1:9956"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	res := server.AddService("web", Service{
+		Name:  "web",
+		Image: "nginx",
+		IPs:   AddressesFromIPs(net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")),
+		Ports: []Port{{Name: "http", Port: 80, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}},
+
+		Provider: "test",
+	})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	testDNSResponses(t, TestAddr, []dnsTestCase{
+		{"_http._tcp.web.nginx.docker.", 1, "SRV", 0},
+		{"_80._tcp.web.nginx.docker.", 1, "SRV", 0},
+		{"_53._udp.nginx.docker.", 1, "SRV", 0},
+		{"web.nginx.docker.", 2, "SRV", 0},
+		{"_http._udp.web.nginx.docker.", 0, "SRV", 0},
+		{"_http._tcp.foo.docker.", 0, "SRV", dns.RcodeNameError},
+		{"web.nginx.docker.", 1, "TXT", 0},
+	})
+
+	m := new(dns.Msg)
+	m.SetQuestion("_http._tcp.nginx.docker.", dns.TypeSRV)
+	r, err := dns.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatal("Expected: 1 SRV record Got:", len(r.Answer))
+	}
+	if srv := r.Answer[0].(*dns.SRV); srv.Port != 80 || srv.Target != "web.nginx.docker." {
+		t.Error("Invalid SRV record", srv)
+	}
+	if len(r.Extra) != 2 {
+		t.Error("Expected: 2 glue records Got:", len(r.Extra))
+	}
+	for _, rr := range r.Extra {
+		if rr.Header().Name != "web.nginx.docker." {
+			t.Error("Invalid glue record", rr)
+		}
+	}
+}
+
+func TestSplitSRVQuery(t *testing.T) {
+	inputs := []struct {
+		query, name, proto, target string
+	}{
+		{"_http._tcp.web.docker", "http", "tcp", "web.docker"},
+		{"_HTTP._TCP.web.docker", "http", "tcp", "web.docker"},
+		{"_8080._udp.docker", "8080", "udp", "docker"},
+		{"web.docker", "", "", "web.docker"},
+		{"_http.web.docker", "", "", "_http.web.docker"},
+	}
+
+	for _, input := range inputs {
+		name, proto, target := splitSRVQuery(input.query)
+		if name != input.name || proto != input.proto || target != input.target {
+			t.Error(input, "Got:", name, proto, target)
+		}
+	}
+}
+
+func TestDNSResponseRecords(t *testing.T) {
+	const TestAddr = "127.0.0.1:9957"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	res := server.AddService("web", Service{
+		Name:  "web",
+		Image: "nginx",
+		IPs:   AddressesFromIPs(net.ParseIP("10.0.0.2")),
+		Records: []string{
+			`@ 300 IN TXT "v=spf1 -all"`,
+			`@ IN CAA 0 issue "letsencrypt.org"`,
+			`_25._tcp IN TLSA 3 1 1 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef`,
+			`www IN CNAME web.nginx.docker.`,
+			`outside.example.com. IN TXT "ignored"`,
+			`not a record`,
+		},
+	})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	testDNSResponses(t, TestAddr, []dnsTestCase{
+		{"web.nginx.docker.", 1, "TXT", 0},
+		{"web.nginx.docker.", 1, "CAA", 0},
+		{"web.nginx.docker.", 1, "A", 0},
+		{"_25._tcp.web.nginx.docker.", 1, "TLSA", 0},
+		{"www.web.nginx.docker.", 1, "CNAME", 0},
+	})
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.web.nginx.docker.", dns.TypeA)
+	r, err := dns.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(r.Answer) != 2 || r.Answer[0].Header().Rrtype != dns.TypeCNAME || r.Answer[1].Header().Rrtype != dns.TypeA {
+		t.Error("Expected a CNAME record followed by its target Got:", r.Answer)
+	}
+
+	if err := server.RemoveService("web"); err != nil {
+		t.Error("Error removing service", err)
+	}
+
+	testDNSResponses(t, TestAddr, []dnsTestCase{
+		{"web.nginx.docker.", 0, "CAA", dns.RcodeNameError},
+		{"_25._tcp.web.nginx.docker.", 0, "TLSA", dns.RcodeNameError},
+	})
+}
+
+func TestDNSResponseMX(t *testing.T) {
+	const TestAddr = "127.0.0.1:9958"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	res := server.AddService("mail", Service{Name: "mail", Image: "postfix", IPs: AddressesFromIPs(net.ParseIP("10.0.0.25")), MX: &MailExchange{Preference: 10}})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+	res = server.AddService("web", Service{Name: "web", Image: "nginx", IPs: AddressesFromIPs(net.ParseIP("10.0.0.80")), MX: &MailExchange{Preference: 20, Exchange: "mail.postfix.docker"}})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+	res = server.AddService("ext", Service{Name: "ext", Image: "nginx", IPs: AddressesFromIPs(net.ParseIP("10.0.0.81")), MX: &MailExchange{Preference: 5, Exchange: "mx.example.com."}})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+	res = server.AddService("plain", Service{Name: "plain", Image: "", IPs: AddressesFromIPs(net.ParseIP("10.0.0.82"))})
+	if res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	inputs := []struct {
+		query      string
+		preference uint16
+		exchange   string
+		extra      int
+	}{
+		{"mail.postfix.docker.", 10, "mail.postfix.docker.", 1},
+		{"web.nginx.docker.", 20, "mail.postfix.docker.", 1},
+		{"ext.nginx.docker.", 5, "mx.example.com.", 0},
+		{"plain.docker.", 0, "", 0},
+	}
+
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, dns.TypeMX)
+		r, err := dns.Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			t.Error(input, "Rcode expected: NOERROR got:", dns.RcodeToString[r.Rcode])
+		}
+
+		if len(input.exchange) == 0 {
+			if len(r.Answer) != 0 {
+				t.Error(input, "Expected no MX record Got:", r.Answer)
+			}
+			continue
+		}
+
+		if len(r.Answer) != 1 {
+			t.Error(input, "Expected: 1 MX record Got:", r.Answer)
+			continue
+		}
+		if mx := r.Answer[0].(*dns.MX); mx.Preference != input.preference || mx.Mx != input.exchange {
+			t.Error(input, "Invalid MX record", mx)
+		}
+		if len(r.Extra) != input.extra {
+			t.Error(input, "Expected:", input.extra, "glue records Got:", r.Extra)
+		}
+	}
+}
+
+func TestDNSResponseCNAME(t *testing.T) {
+	const TestAddr = "127.0.0.1:9959"
+	const UpstreamAddr = "127.0.0.1:9960"
+
+	// upstream nameserver answering out of zone targets
+	upstream := &dns.Server{Addr: UpstreamAddr, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "external.example.com." {
+			rr, _ := dns.NewRR("external.example.com. 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		} else {
+			m.SetRcode(r, dns.RcodeNameError)
+		}
+		w.WriteMsg(m) //nolint:errcheck
+	})}
+	go upstream.ListenAndServe() //nolint:errcheck
+	defer upstream.Shutdown()    //nolint:errcheck
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+	config.CnameMaxDepth = 2
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	services := map[string]Service{
+		"api":    {Name: "api", CNAME: "api-v2.staging.docker"},
+		"apiv2":  {Name: "api-v2", Image: "staging", IPs: AddressesFromIPs(net.ParseIP("10.0.0.5"))},
+		"ext":    {Name: "ext", CNAME: "external.example.com"},
+		"gone":   {Name: "gone", CNAME: "missing.example.com"},
+		"dang":   {Name: "dang", CNAME: "nothing.docker"},
+		"loop1":  {Name: "loop1", CNAME: "loop2.docker"},
+		"loop2":  {Name: "loop2", CNAME: "loop1.docker"},
+		"chain1": {Name: "chain1", CNAME: "chain2.docker"},
+		"chain2": {Name: "chain2", CNAME: "chain3.docker"},
+		"chain3": {Name: "chain3", CNAME: "api-v2.staging.docker"},
+	}
+	for id, service := range services {
+		if res := server.AddService(id, service); res != nil {
+			t.Error("Error adding service", res)
+		}
+	}
+
+	inputs := []struct {
+		query string
+		qType uint16
+		types []uint16
+		rcode int
+	}{
+		{"api.docker.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeA}, dns.RcodeSuccess},
+		{"api.docker.", dns.TypeAAAA, []uint16{dns.TypeCNAME}, dns.RcodeSuccess},
+		{"api.docker.", dns.TypeCNAME, []uint16{dns.TypeCNAME}, dns.RcodeSuccess},
+		{"ext.docker.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeA}, dns.RcodeSuccess},
+		{"gone.docker.", dns.TypeA, []uint16{dns.TypeCNAME}, dns.RcodeNameError},
+		{"dang.docker.", dns.TypeA, []uint16{dns.TypeCNAME}, dns.RcodeNameError},
+		{"loop1.docker.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeCNAME}, dns.RcodeServerFailure},
+		{"chain1.docker.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeCNAME}, dns.RcodeServerFailure},
+		{"chain2.docker.", dns.TypeA, []uint16{dns.TypeCNAME, dns.TypeCNAME, dns.TypeA}, dns.RcodeSuccess},
+	}
+
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, input.qType)
+		r, err := dns.Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		if r.Rcode != input.rcode {
+			t.Error(input, "Rcode expected:", dns.RcodeToString[input.rcode], "got:", dns.RcodeToString[r.Rcode])
+		}
+
+		types := []uint16{}
+		for _, rr := range r.Answer {
+			types = append(types, rr.Header().Rrtype)
+		}
+		if !reflect.DeepEqual(types, input.types) {
+			t.Error(input, "Unexpected answer", r.Answer)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	inputs := []struct {
+		record, expected string
+	}{
+		{`@ 300 IN TXT "v=spf1 -all"`, "web.docker.\t300\tIN\tTXT\t\"v=spf1 -all\""},
+		{`www IN CNAME @`, "www.web.docker.\t30\tIN\tCNAME\tweb.docker."},
+		{`other.docker. 10 IN A 10.0.0.1`, "other.docker.\t10\tIN\tA\t10.0.0.1"},
+		{`@ IN A`, ""},
+		{``, ""},
+	}
+
+	for _, input := range inputs {
+		rr, err := parseRecord("web.docker", 30, input.record)
+		actual := ""
+		if err == nil {
+			actual = rr.String()
+		}
+		if actual != input.expected {
+			t.Error(input.record, "Expected:", input.expected, "Got:", actual, err)
+		}
+	}
+}
+
+func TestServiceTXT(t *testing.T) {
+	config := utils.NewConfig()
+	server := NewDNSServer(config)
+
+	service := NewService("docker")
+	service.Name = "web"
+	service.IPs = AddressesFromIPs(net.ParseIP("10.0.0.2"))
+	service.Metadata = map[string]string{"id": "abcdef", "image": "nginx:latest", "created": "2024-01-01T00:00:00Z"}
+	long := strings.Repeat("a", 300)
+	service.Labels = map[string]string{"com.docker.compose.project": "shop", "other": "value", "long": long, "path": `C:\data`}
+
+	inputs := []struct {
+		fields, labels []string
+		expected       string
+	}{
+		{config.TxtFields, config.TxtLabels, "id=abcdef,image=nginx:latest,provider=docker,created=2024-01-01T00:00:00Z,com.docker.compose.project=shop"},
+		{[]string{"provider", "unknown"}, []string{"other", "missing"}, "provider=docker,other=value"},
+		{nil, nil, ""},
+		// the strings are limited to 255 bytes
+		{nil, []string{"long", "path"}, "long=" + long[:250] + "," + long[250:] + `,path=C:\\data`},
+	}
+
+	for _, input := range inputs {
+		config.TxtFields = input.fields
+		config.TxtLabels = input.labels
+
+		rrs := server.makeServiceTXT("web.docker.", service)
+		actual := ""
+		if len(rrs) == 1 {
+			actual = strings.Join(rrs[0].(*dns.TXT).Txt, ",")
+		} else if len(rrs) > 1 {
+			t.Error("Expected a single TXT record Got:", len(rrs))
+		}
+		if actual != input.expected {
+			t.Error(input, "Expected:", input.expected, "Got:", actual)
+		}
+
+		m := new(dns.Msg)
+		m.Answer = rrs
+		if _, err := m.Pack(); err != nil {
+			t.Error(input, "Error packing TXT record", err)
+		}
+	}
+}
+
+type dnsTestCase struct {
+	query    string
+	expected int
+	qType    string
+	rcode    int
+}
+
+func testDNSResponses(t *testing.T, addr string, inputs []dnsTestCase) {
+	c := new(dns.Client)
+	for _, input := range inputs {
+		t.Log("Query", input.query, input.qType)
+		qType := dns.StringToType[input.qType]
+
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, qType)
+		r, _, err := c.Exchange(m, addr)
+
+		if err != nil {
+			t.Error("Error response from the server", err)
+			break
+		}
+
+		if len(r.Answer) != input.expected {
+			t.Error(input, "Expected:", input.expected, " Got:", len(r.Answer))
+		}
+
+		if r.Rcode != input.rcode {
+			t.Error(input, "Rcode expected:", dns.RcodeToString[input.rcode], " got:", dns.RcodeToString[r.Rcode])
+		}
+
+		for _, a := range r.Answer {
+			if rrType := dns.Type(a.Header().Rrtype).String(); input.qType != rrType {
+				t.Error("Did not receive ", input.qType, " resource record")
+			}
+		}
+	}
+}
+
+func TestServiceMatchIPs(t *testing.T) {
+	service := &Service{
+		Name: "foo",
+		IPs: []Address{
+			NewAddress(net.ParseIP("10.0.1.2"), "front", 24),
+			NewAddress(net.ParseIP("fd00:1::2"), "front", 64),
+			NewAddress(net.ParseIP("10.0.2.2"), "back", 24),
+			{IP: net.ParseIP("192.168.0.2")},
+		},
+	}
+
+	inputs := []struct {
+		network, client string
+		order           []string
+		expected        []string
+	}{
+		{"", "10.0.1.100", nil, []string{"10.0.1.2", "fd00:1::2"}},
+		{"", "10.0.2.100", nil, []string{"10.0.2.2", "fd00:1::2"}},
+		{"", "fd00:1::100", []string{"back"}, []string{"fd00:1::2", "10.0.2.2", "10.0.1.2", "192.168.0.2"}},
+		{"", "fd00:2::100", nil, []string{"10.0.1.2", "fd00:1::2", "10.0.2.2", "192.168.0.2"}},
+		{"", "172.17.0.1", nil, []string{"10.0.1.2", "fd00:1::2", "10.0.2.2", "192.168.0.2"}},
+		{"", "172.17.0.1", []string{"back"}, []string{"10.0.2.2", "10.0.1.2", "fd00:1::2", "192.168.0.2"}},
+		{"", "", []string{"back", "front"}, []string{"10.0.2.2", "10.0.1.2", "fd00:1::2", "192.168.0.2"}},
+		{"back", "10.0.1.100", nil, []string{"10.0.2.2"}},
+	}
+
+	for _, input := range inputs {
+		match := &serviceMatch{service: service, network: input.network}
+		actual := []string{}
+		for _, ip := range match.ips(net.ParseIP(input.client), input.order) {
+			actual = append(actual, ip.String())
+		}
+		if strings.Join(actual, ",") != strings.Join(input.expected, ",") {
+			t.Error(input, "Expected:", input.expected, "Got:", actual)
+		}
+	}
+}
+
+func TestDNSResponseTCP(t *testing.T) {
+	const TestAddr = "127.0.0.1:9961"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	stopped := make(chan error)
+	go func() {
+		stopped <- server.Start()
+	}()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	// enough services for a wildcard answer not to fit in 512 bytes
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("service%d", i)
+		res := server.AddService(id, Service{Name: id, Image: "bar", IPs: AddressesFromIPs(net.IPv4(10, 0, 0, byte(i)))})
+		if res != nil {
+			t.Error("Error adding service", res)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("*.docker.", dns.TypeA)
+
+	udp := &dns.Client{Net: "udp"}
+	r, _, err := udp.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if !r.Truncated {
+		t.Error("UDP response should be truncated")
+	}
+	if len(r.Answer) >= 50 {
+		t.Error("UDP response should not contain all the records Got:", len(r.Answer))
+	}
+
+	tcp := &dns.Client{Net: "tcp"}
+	r, _, err = tcp.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if r.Truncated || len(r.Answer) != 50 {
+		t.Error("TCP response should contain all the records Got:", len(r.Answer))
+	}
+
+	m.SetQuestion("service1.bar.docker.", dns.TypeA)
+	r, _, err = udp.Exchange(m, TestAddr)
+	if err != nil || r.Truncated || len(r.Answer) != 1 {
+		t.Error("Small UDP response should not be truncated", r, err)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error("Server stopped with error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Server did not stop")
+	}
+}
+
+func TestDNSResponseEDNS(t *testing.T) {
+	const TestAddr = "127.0.0.1:9962"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	addServices := func(from, to int) {
+		for i := from; i < to; i++ {
+			id := fmt.Sprintf("service%d", i)
+			res := server.AddService(id, Service{Name: id, Image: "bar", IPs: AddressesFromIPs(net.IPv4(10, 0, 0, byte(i)))})
+			if res != nil {
+				t.Error("Error adding service", res)
+			}
+		}
+	}
+	exchange := func(size uint16, do bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("*.docker.", dns.TypeA)
+		m.SetEdns0(size, do)
+		r, _, err := new(dns.Client).Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return r
+	}
+
+	// does not fit in 512 bytes but fits in the default maximum size
+	addServices(0, 50)
+
+	r := exchange(4096, true)
+	if r.Truncated || len(r.Answer) != 50 {
+		t.Error("EDNS0 response should contain all the records Got:", len(r.Answer))
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		t.Fatal("EDNS0 response should contain an OPT record")
+	}
+	if opt.UDPSize() != uint16(config.EdnsMaxUDPSize) || !opt.Do() {
+		t.Error("Unexpected OPT record", opt)
+	}
+
+	r = exchange(600, false)
+	if !r.Truncated || r.IsEdns0() == nil {
+		t.Error("Response should be truncated to the size advertised by the client")
+	}
+
+	// does not fit in the default maximum size
+	addServices(50, 100)
+
+	r = exchange(4096, false)
+	if !r.Truncated || r.IsEdns0() == nil {
+		t.Error("Response should be truncated to the maximum size of the server")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("service1.bar.docker.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().SetVersion(1)
+	r, _, err := new(dns.Client).Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if r.Rcode != dns.RcodeBadVers || len(r.Answer) != 0 {
+		t.Error("Unsupported EDNS version should be answered with BADVERS Got:", dns.RcodeToString[r.Rcode])
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
+
+func TestDNSResponseTLS(t *testing.T) {
+	const TestAddr = "127.0.0.1:9963"
+
+	certFile, keyFile, pool := writeTestCertificate(t, t.TempDir(), 1)
+
+	config := utils.NewConfig()
+	config.DnsAddr = "127.0.0.1:9964"
+	config.DotAddr = TestAddr
+	config.DotCert = certFile
+	config.DotKey = keyFile
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	waitListening(t, "tcp", TestAddr)
+
+	if res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("foo.bar.docker.", dns.TypeA)
+
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}
+	r, _, err := c.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Error("Unexpected answer", r.Answer)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
+
 func TestServiceManagement(t *testing.T) {
 	list := ServiceListProvider(NewDNSServer(utils.NewConfig()))
 
@@ -126,7 +844,7 @@ func TestServiceManagement(t *testing.T) {
 		t.Error("Initial service count should be 0.")
 	}
 
-	A := Service{Name: "bar", IPs: []net.IP{net.ParseIP("127.0.0.1")}}
+	A := Service{Name: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))}
 	res := list.AddService("foo", A)
   if res != nil {
     t.Error("Error adding service", res)
@@ -153,7 +871,7 @@ func TestServiceManagement(t *testing.T) {
 		t.Error("Request to boo should have failed")
 	}
 
-	res = list.AddService("boo", Service{Name: "boo", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res = list.AddService("boo", Service{Name: "boo", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
@@ -186,7 +904,7 @@ func TestServiceManagement(t *testing.T) {
 		t.Error("Item count after remove should be 1")
 	}
 
-	res = list.AddService("416261e74515b7dd1dbd55f35e8625b063044f6ddf74907269e07e9f142bc0df", Service{Name: "mysql", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res = list.AddService("416261e74515b7dd1dbd55f35e8625b063044f6ddf74907269e07e9f142bc0df", Service{Name: "mysql", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
@@ -209,19 +927,19 @@ func TestServiceManagement(t *testing.T) {
 func TestDNSRequestMatch(t *testing.T) {
 	server := NewDNSServer(utils.NewConfig())
 
-	res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
-	res = server.AddService("baz", Service{Name: "baz", Image: "bar", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res = server.AddService("baz", Service{Name: "baz", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
 	if res != nil {
     t.Error("Error adding service", res)
   }
-  res = server.AddService("abc", Service{Name: "def", Image: "ghi", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+  res = server.AddService("abc", Service{Name: "def", Image: "ghi", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
 	if res != nil {
     t.Error("Error adding service", res)
   }
-  res = server.AddService("qux", Service{Name: "qux", Image: "", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+  res = server.AddService("qux", Service{Name: "qux", Image: "", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
@@ -267,19 +985,19 @@ func TestDNSRequestMatch(t *testing.T) {
 func TestDNSRequestMatchNamesWithDots(t *testing.T) {
 	server := NewDNSServer(utils.NewConfig())
 
-	res := server.AddService("boo", Service{Name: "foo.boo", Image: "bar.zar", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res := server.AddService("boo", Service{Name: "foo.boo", Image: "bar.zar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
-	res = server.AddService("baz", Service{Name: "baz", Image: "bar.zar", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res = server.AddService("baz", Service{Name: "baz", Image: "bar.zar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
 	if res != nil {
     t.Error("Error adding service", res)
   }
-  res = server.AddService("abc", Service{Name: "bar", Image: "zar", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+  res = server.AddService("abc", Service{Name: "bar", Image: "zar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
 	if res != nil {
     t.Error("Error adding service", res)
   }
-  res = server.AddService("qux", Service{Name: "qux.quu", Image: "", IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+  res = server.AddService("qux", Service{Name: "qux.quu", Image: "", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
@@ -322,15 +1040,15 @@ func TestDNSRequestMatchNamesWithDots(t *testing.T) {
 func TestGetExpandedID(t *testing.T) {
 	server := NewDNSServer(utils.NewConfig())
 
-	res := server.AddService("416261e74515b7dd1dbd55f35e8625b063044f6ddf74907269e07e9f142bc0df", Service{IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res := server.AddService("416261e74515b7dd1dbd55f35e8625b063044f6ddf74907269e07e9f142bc0df", Service{IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
-	res = server.AddService("316261e74515b7dd1dbd55f35e8625b063044f6ddf74907269e07e9f14nothex", Service{IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	res = server.AddService("316261e74515b7dd1dbd55f35e8625b063044f6ddf74907269e07e9f14nothex", Service{IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
 	if res != nil {
-    t.Error("Error adding service", Service{IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+    t.Error("Error adding service", Service{IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   }
-  res = server.AddService("abcdefabcdef", Service{IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+  res = server.AddService("abcdefabcdef", Service{IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))})
   if res != nil {
     t.Error("Error adding service", res)
   }
@@ -353,6 +1071,35 @@ func TestGetExpandedID(t *testing.T) {
 
 }
 
+func TestReverseToIP(t *testing.T) {
+	inputs := map[string]string{
+		"4.3.2.1.in-addr.arpa.": "1.2.3.4",
+		"4.3.2.1.in-addr.arpa":  "1.2.3.4",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.D.F.ip6.arpa.": "fd00::1",
+		"b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa":  "2001:db8::567:89ab",
+	}
+
+	for input, expected := range inputs {
+		if actual := reverseToIP(input); !actual.Equal(net.ParseIP(expected)) {
+			t.Error(input, "Expected:", expected, "Got:", actual)
+		}
+	}
+
+	invalid := []string{
+		"3.2.1.in-addr.arpa.",
+		"foo.3.2.1.in-addr.arpa.",
+		"1.0.0.ip6.arpa.",
+		"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+		"example.com.",
+	}
+
+	for _, input := range invalid {
+		if actual := reverseToIP(input); actual != nil {
+			t.Error(input, "Expected: nil Got:", actual)
+		}
+	}
+}
+
 func TestIsPrefixQuery(t *testing.T) {
 	tests := []struct {
 		query, name string
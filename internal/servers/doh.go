@@ -0,0 +1,161 @@
+/* doh.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// DoHPath is the path of the DNS-over-HTTPS endpoint
+const DoHPath = "/dns-query"
+
+// DoHMediaType is the media type of the DNS-over-HTTPS messages
+const DoHMediaType = "application/dns-message"
+
+// dohHandler serves DNS-over-HTTPS requests (RFC 8484) with a DNS handler
+type dohHandler struct {
+	handler dns.Handler
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var data []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != DoHMediaType {
+			http.Error(w, fmt.Sprintf("Content type must be %s", DoHMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(data); err != nil {
+		logger.Debugf("Invalid DNS-over-HTTPS message from '%s': %s", req.RemoteAddr, err)
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{remote: req.RemoteAddr}
+	h.handler.ServeDNS(rw, r)
+	if rw.msg == nil {
+		http.Error(w, "No response", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := rw.msg.Pack()
+	if err != nil {
+		logger.Errorf("Unable to pack response: '%s'", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DoHMediaType)
+	if ttl, ok := minTTL(rw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(res) //nolint:errcheck
+}
+
+// minTTL returns the lowest TTL of the records of a message, which is used
+// as the freshness lifetime of DNS-over-HTTPS responses
+func minTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				ok = true
+			}
+		}
+	}
+	return
+}
+
+// dohResponseWriter captures the response of a DNS handler. Messages are not
+// limited in size as they are sent over HTTP.
+type dohResponseWriter struct {
+	remote string
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	addr := &net.TCPAddr{}
+	if host, _, err := net.SplitHostPort(w.remote); err == nil {
+		addr.IP = net.ParseIP(host)
+	}
+	return addr
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(data []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(data), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// TsigStatus rejects the signed requests as TSIG signatures are not verified
+func (w *dohResponseWriter) TsigStatus() error { return dns.ErrSecret }
+
+// httpListener runs an HTTP server along with the DNS listeners
+type httpListener struct {
+	server *http.Server
+}
+
+func (l *httpListener) ListenAndServe() error {
+	var err error
+	if l.server.TLSConfig != nil {
+		err = l.server.ListenAndServeTLS("", "")
+	} else {
+		err = l.server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (l *httpListener) Shutdown() error {
+	return l.server.Shutdown(context.Background())
+}
@@ -0,0 +1,161 @@
+/* doh_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// dohExchange sends a DNS-over-HTTPS request with the given method and
+// returns the decoded response
+func dohExchange(t *testing.T, client *http.Client, method, url string, m *dns.Msg) (*dns.Msg, *http.Response) {
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal("Error packing message", err)
+	}
+
+	var req *http.Request
+	if method == http.MethodGet {
+		req, err = http.NewRequest(method, url+"?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+	} else {
+		req, err = http.NewRequest(method, url, bytes.NewReader(data))
+		req.Header.Set("Content-Type", DoHMediaType)
+	}
+	if err != nil {
+		t.Fatal("Error creating request", err)
+	}
+	req.Header.Set("Accept", DoHMediaType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp
+	}
+	if resp.Header.Get("Content-Type") != DoHMediaType {
+		t.Error("Unexpected content type", resp.Header.Get("Content-Type"))
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	res := new(dns.Msg)
+	if err := res.Unpack(body); err != nil {
+		t.Fatal("Error unpacking response", err)
+	}
+	return res, resp
+}
+
+func TestDoHRequests(t *testing.T) {
+	const TestAddr = "127.0.0.1:9981"
+
+	// the listener uses plain HTTP without certificate
+	config := utils.NewConfig()
+	config.DnsAddr = "127.0.0.1:9998"
+	config.DohAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	waitListening(t, "tcp", TestAddr)
+
+	if res := server.AddService("foo", Service{Name: "foo", Image: "bar", TTL: 30, IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("foo.bar.docker.", dns.TypeA)
+	m.Id = 0
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		r, resp := dohExchange(t, http.DefaultClient, method, "http://"+TestAddr+DoHPath, m)
+		if r == nil {
+			t.Fatal("Unexpected status", method, resp.Status)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Error("Unexpected answer", method, r.Answer)
+		}
+		if resp.Header.Get("Cache-Control") != "max-age=30" {
+			t.Error("Unexpected cache control", method, resp.Header.Get("Cache-Control"))
+		}
+	}
+
+	var tests = []struct {
+		method, url, contentType string
+		status                   int
+	}{
+		{"GET", DoHPath, "", 400},
+		{"GET", DoHPath + "?dns=invalid", "", 400},
+		{"POST", DoHPath, "text/plain", 415},
+		{"PUT", DoHPath, DoHMediaType, 405},
+	}
+	for _, input := range tests {
+		req, _ := http.NewRequest(input.method, "http://"+TestAddr+input.url, bytes.NewReader([]byte{0}))
+		req.Header.Set("Content-Type", input.contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != input.status {
+			t.Error(input, "Expected status:", input.status, "Got:", resp.StatusCode)
+		}
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
+
+func TestDoHListener(t *testing.T) {
+	const TestAddr = "127.0.0.1:9966"
+
+	certFile, keyFile, pool := writeTestCertificate(t, t.TempDir(), 1)
+
+	config := utils.NewConfig()
+	config.DnsAddr = "127.0.0.1:9965"
+	config.DohAddr = TestAddr
+	config.DohCert = certFile
+	config.DohKey = keyFile
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	waitListening(t, "tcp", TestAddr)
+
+	if res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+
+	m := new(dns.Msg)
+	m.SetQuestion("foo.bar.docker.", dns.TypeA)
+	r, resp := dohExchange(t, client, http.MethodPost, "https://"+TestAddr+DoHPath, m)
+	if r == nil {
+		t.Fatal("Unexpected status", resp.Status)
+	}
+	if len(r.Answer) != 1 {
+		t.Error("Unexpected answer", r.Answer)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
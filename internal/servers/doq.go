@@ -0,0 +1,220 @@
+/* doq.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// error codes of DNS-over-QUIC connections as per RFC 9250 sec. 4.3
+const (
+	doqNoError       quic.ApplicationErrorCode = 0
+	doqInternalError quic.ApplicationErrorCode = 1
+	doqProtocolError quic.ApplicationErrorCode = 2
+)
+
+// doqServer serves DNS-over-QUIC requests (RFC 9250) with a DNS handler.
+// Each query is sent on its own stream, prefixed by its length.
+type doqServer struct {
+	addr      string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	handler   dns.Handler
+
+	conn      net.PacketConn
+	transport *quic.Transport
+	listener  *quic.Listener
+	cancel    context.CancelFunc
+	done      chan struct{}
+	wg        sync.WaitGroup
+	lock      sync.Mutex
+	// closed is set by Shutdown, the server does not start after it
+	closed bool
+}
+
+// ListenAndServe accepts connections until the server is shut down
+func (s *doqServer) ListenAndServe() error {
+	// the socket is managed apart from the listener for the connections to
+	// be closed properly when the server stops
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.Listen(s.tlsConfig, &quic.Config{MaxIdleTimeout: s.timeout})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer close(done)
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		cancel()
+		return errors.Join(listener.Close(), transport.Close(), conn.Close())
+	}
+	s.conn = conn
+	s.transport = transport
+	s.listener = listener
+	s.cancel = cancel
+	s.done = done
+	s.lock.Unlock()
+
+	// the connections which are still queued when the listener is closed
+	// are accepted and closed right away as the context is cancelled
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			cancel()
+			return err
+		}
+
+		s.wg.Add(1)
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// Shutdown closes the listener and the open connections. A server shut down
+// before it is started does not start.
+func (s *doqServer) Shutdown() error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+
+	s.cancel()
+	err := s.listener.Close()
+	<-s.done
+	s.wg.Wait()
+	s.listener = nil
+	return errors.Join(err, s.transport.Close(), s.conn.Close())
+}
+
+func (s *doqServer) serveConn(ctx context.Context, conn quic.Connection) {
+	defer s.wg.Done()
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			// the connection is closed when idle or when the server stops
+			if ctx.Err() != nil {
+				conn.CloseWithError(doqNoError, "") //nolint:errcheck
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serveStream(conn, stream)
+	}
+}
+
+func (s *doqServer) serveStream(conn quic.Connection, stream quic.Stream) {
+	defer s.wg.Done()
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(s.timeout)) //nolint:errcheck
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		logger.Debugf("Unable to read DNS-over-QUIC query from '%s': %s", conn.RemoteAddr(), err)
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(stream, data); err != nil {
+		logger.Debugf("Unable to read DNS-over-QUIC query from '%s': %s", conn.RemoteAddr(), err)
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+
+	// the message ID must be 0 as per RFC 9250 sec. 4.2.1
+	r := new(dns.Msg)
+	if err := r.Unpack(data); err != nil || r.Id != 0 {
+		logger.Debugf("Invalid DNS-over-QUIC query from '%s'", conn.RemoteAddr())
+		conn.CloseWithError(doqProtocolError, "invalid query") //nolint:errcheck
+		return
+	}
+
+	w := &doqResponseWriter{conn: conn, stream: stream}
+	s.handler.ServeDNS(w, r)
+	if !w.written {
+		stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+	}
+}
+
+// doqResponseWriter writes a response on a DNS-over-QUIC stream
+type doqResponseWriter struct {
+	conn    quic.Connection
+	stream  quic.Stream
+	written bool
+}
+
+func (w *doqResponseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the client. Streams are not limited in
+// size, so the address is returned as a TCP address for the responses not to
+// be truncated.
+func (w *doqResponseWriter) RemoteAddr() net.Addr {
+	if addr, ok := w.conn.RemoteAddr().(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	}
+	return w.conn.RemoteAddr()
+}
+
+func (w *doqResponseWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *doqResponseWriter) Write(data []byte) (int, error) {
+	if len(data) > dns.MaxMsgSize {
+		return 0, dns.ErrBuf
+	}
+	w.written = true
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+	if _, err := w.stream.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *doqResponseWriter) Close() error        { return w.stream.Close() }
+func (w *doqResponseWriter) TsigTimersOnly(bool) {}
+func (w *doqResponseWriter) Hijack()             {}
+
+// TsigStatus rejects the signed requests as TSIG signatures are not verified
+func (w *doqResponseWriter) TsigStatus() error { return dns.ErrSecret }
@@ -0,0 +1,164 @@
+/* doq_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqExchange sends a query on a new stream of a DNS-over-QUIC connection
+func doqExchange(conn quic.Connection, m *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	if _, err := stream.Write(append(buf, data...)); err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	res, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 2 || int(binary.BigEndian.Uint16(res)) != len(res)-2 {
+		return nil, errors.New("invalid response length")
+	}
+
+	r := new(dns.Msg)
+	return r, r.Unpack(res[2:])
+}
+
+func TestDNSResponseQUIC(t *testing.T) {
+	const TestAddr = "127.0.0.1:9967"
+
+	certFile, keyFile, pool := writeTestCertificate(t, t.TempDir(), 1)
+
+	config := utils.NewConfig()
+	config.DnsAddr = "127.0.0.1:9968"
+	config.DoqAddr = TestAddr
+	config.DoqCert = certFile
+	config.DoqKey = keyFile
+
+	server := NewDNSServer(config)
+	stopped := make(chan error)
+	go func() {
+		stopped <- server.Start()
+	}()
+
+	if res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("127.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	// the server is started once it accepts a connection
+	tlsConfig := &tls.Config{RootCAs: pool, NextProtos: []string{"doq"}, MinVersion: tls.VersionTLS12}
+	var conn quic.Connection
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		conn, err = quic.DialAddr(ctx, TestAddr, tlsConfig, nil)
+		cancel()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal("Error connecting to the server", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("foo.bar.docker.", dns.TypeA)
+	m.Id = 0
+
+	// several queries are sent on the same connection
+	for i := 0; i < 2; i++ {
+		r, err := doqExchange(conn, m)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		if r.Id != 0 || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Error("Unexpected response", r)
+		}
+	}
+
+	// a non zero message ID is a protocol error
+	m.Id = 1
+	if _, err := doqExchange(conn, m); err == nil {
+		t.Error("Query with a message ID should fail")
+	}
+	var appErr *quic.ApplicationError
+	<-conn.Context().Done()
+	if !errors.As(context.Cause(conn.Context()), &appErr) || appErr.ErrorCode != doqProtocolError {
+		t.Error("Connection should be closed with a protocol error Got:", context.Cause(conn.Context()))
+	}
+
+	// open connections are closed when the server stops, the query makes sure
+	// the server accepted the connection
+	conn, err = quic.DialAddr(context.Background(), TestAddr, tlsConfig, nil)
+	if err != nil {
+		t.Fatal("Error connecting to the server", err)
+	}
+	m.Id = 0
+	if _, err := doqExchange(conn, m); err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(time.Second):
+		t.Error("Connection was not closed")
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error("Server stopped with error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Server did not stop")
+	}
+}
+
+func TestDoQShutdownBeforeStart(t *testing.T) {
+	const TestAddr = "127.0.0.1:9952"
+
+	certFile, keyFile, _ := writeTestCertificate(t, t.TempDir(), 1)
+	server := &doqServer{addr: TestAddr, timeout: time.Second, tlsConfig: newCertReloader(certFile, keyFile).tlsConfig("doq")}
+
+	// the server stopped before it starts does not listen
+	if err := server.Shutdown(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+	if err := server.ListenAndServe(); err != nil {
+		t.Error("Server stopped with error", err)
+	}
+	conn, err := net.ListenPacket("udp", TestAddr)
+	if err != nil {
+		t.Fatal("The address of the server should be released", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,271 @@
+/* export.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// the exported records are updated again after this delay when an update fails
+	exportRetryDelay = 30 * time.Second
+	// prefix of the names of the TXT records which mark the exported names
+	exportOwnerPrefix = "_dnsdock."
+)
+
+// exporter publishes the records of the zone to a primary server with
+// dynamic updates. Every exported name gets an ownership TXT record so that
+// the records left over by a previous run are removed when it starts, while
+// the records added by other means are kept.
+type exporter struct {
+	server  *DNSServer
+	changes chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// exported holds the records present on the primary, by presentation
+	// format. It is nil until they are read from the primary.
+	exported map[string]dns.RR
+}
+
+// newExporter creates an exporter of the records of a DNSServer
+func newExporter(s *DNSServer) *exporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &exporter{server: s, changes: make(chan struct{}, 1), ctx: ctx, cancel: cancel}
+}
+
+// changed tells the exporter that the zone changed, it never blocks
+func (e *exporter) changed() {
+	select {
+	case e.changes <- struct{}{}:
+	default:
+	}
+}
+
+// ListenAndServe exports the records until the exporter is shut down. The
+// changes happening within notifyDelay are sent together.
+func (e *exporter) ListenAndServe() error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return nil
+		case <-e.changes:
+			timer.Reset(notifyDelay)
+		case <-timer.C:
+			if err := e.sync(); err != nil {
+				logger.Warningf("Unable to export the records to '%s': %s", e.server.config.ExportAddr, err)
+				timer.Reset(exportRetryDelay)
+			}
+		}
+	}
+}
+
+// Shutdown stops the exporter
+func (e *exporter) Shutdown() error {
+	e.cancel()
+	return nil
+}
+
+// zone returns the zone of the primary
+func (e *exporter) zone() string {
+	if len(e.server.config.ExportZone) > 0 {
+		return strings.ToLower(dns.Fqdn(e.server.config.ExportZone))
+	}
+	return strings.ToLower(e.server.config.Domain.String() + ".")
+}
+
+// ownership returns the TXT record marking a name as exported
+func (e *exporter) ownership(name string) dns.RR {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   exportOwnerPrefix + name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(e.server.config.Ttl),
+		},
+		Txt: []string{"heritage=dnsdock,owner=" + e.server.config.ExportOwner},
+	}
+}
+
+// desired returns the records which must be present on the primary. The
+// apex and the name server of the domain are not exported.
+func (e *exporter) desired() map[string]dns.RR {
+	zone := e.zone()
+	res := make(map[string]dns.RR)
+	for _, rr := range e.server.zoneRecords() {
+		name := strings.ToLower(rr.Header().Name)
+		if e.server.isZoneName(name) || rr.Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		if !dns.IsSubDomain(zone, name) {
+			logger.Debugf("Record '%s' is outside of the exported zone '%s'", rr, zone)
+			continue
+		}
+		res[rr.String()] = rr
+		txt := e.ownership(name)
+		res[txt.String()] = txt
+	}
+	return res
+}
+
+// owned transfers the zone from the primary and returns the records of the
+// names marked as exported by this owner
+func (e *exporter) owned() (map[string]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(e.zone())
+	e.sign(m)
+
+	tr := &dns.Transfer{TsigSecret: e.server.config.TsigKeys}
+	envs, err := tr.In(m, e.server.config.ExportAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	rrs := make([]dns.RR, 0)
+	for env := range envs {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+
+	names := make(map[string]bool)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if !strings.HasPrefix(name, exportOwnerPrefix) {
+			continue
+		}
+		owner := strings.TrimPrefix(name, exportOwnerPrefix)
+		if dns.IsDuplicate(rr, e.ownership(owner)) {
+			names[owner] = true
+		}
+	}
+
+	res := make(map[string]dns.RR)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		rrtype := rr.Header().Rrtype
+		if rrtype == dns.TypeSOA || rrtype == dns.TypeNS {
+			continue
+		}
+		if names[name] || (strings.HasPrefix(name, exportOwnerPrefix) && names[strings.TrimPrefix(name, exportOwnerPrefix)]) {
+			res[rr.String()] = rr
+		}
+	}
+	return res, nil
+}
+
+// sign signs a message with the export TSIG key if there is one
+func (e *exporter) sign(m *dns.Msg) {
+	if key := e.server.config.ExportKey; len(key) > 0 {
+		m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+}
+
+// sync updates the records of the primary. The records of the previous runs
+// are read from the primary the first time, the stale ones are not removed
+// if the zone cannot be transferred.
+func (e *exporter) sync() (err error) {
+	if e.exported == nil {
+		exported, xfrErr := e.owned()
+		if xfrErr != nil {
+			logger.Warningf("Unable to transfer the zone from '%s', the stale records are not removed: %s", e.server.config.ExportAddr, xfrErr)
+			exported = make(map[string]dns.RR)
+			// the zone is transferred again if the primary is not reachable
+			defer func() {
+				if err != nil {
+					e.exported = nil
+				}
+			}()
+		}
+		e.exported = exported
+	}
+
+	desired := e.desired()
+
+	// the removals are sent before the additions so that a record whose TTL
+	// changed is added again
+	removed := make([]string, 0)
+	for key := range e.exported {
+		if _, ok := desired[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	added := make([]string, 0)
+	for key := range desired {
+		if _, ok := e.exported[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+
+	for len(removed) > 0 {
+		n := min(len(removed), xfrChunkSize)
+		rrs := make([]dns.RR, 0, n)
+		for _, key := range removed[:n] {
+			rrs = append(rrs, dns.Copy(e.exported[key]))
+		}
+		m := new(dns.Msg)
+		m.SetUpdate(e.zone())
+		m.Remove(rrs)
+		if err := e.update(m); err != nil {
+			return err
+		}
+		for _, key := range removed[:n] {
+			delete(e.exported, key)
+		}
+		removed = removed[n:]
+	}
+
+	for len(added) > 0 {
+		n := min(len(added), xfrChunkSize)
+		rrs := make([]dns.RR, 0, n)
+		for _, key := range added[:n] {
+			rrs = append(rrs, desired[key])
+		}
+		m := new(dns.Msg)
+		m.SetUpdate(e.zone())
+		m.Insert(rrs)
+		if err := e.update(m); err != nil {
+			return err
+		}
+		for _, key := range added[:n] {
+			e.exported[key] = desired[key]
+		}
+		added = added[n:]
+	}
+
+	return nil
+}
+
+// update sends an update to the primary
+func (e *exporter) update(m *dns.Msg) error {
+	e.sign(m)
+
+	c := &dns.Client{Net: "tcp", TsigSecret: e.server.config.TsigKeys}
+	r, _, err := c.Exchange(m, e.server.config.ExportAddr)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update failed with %s", dns.RcodeToString[r.Rcode])
+	}
+
+	logger.Debugf("Exported %d records to '%s'", len(m.Ns), e.server.config.ExportAddr)
+	return nil
+}
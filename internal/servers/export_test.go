@@ -0,0 +1,159 @@
+/* export_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// testPrimary is a primary server applying the dynamic updates it receives
+type testPrimary struct {
+	zone    string
+	records []dns.RR
+	lock    sync.Mutex
+}
+
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		w.WriteMsg(m) //nolint:errcheck
+		return
+	}
+
+	defer p.lock.Unlock()
+	p.lock.Lock()
+
+	soa, _ := dns.NewRR(p.zone + " 0 IN SOA ns. mbox. 1 0 0 0 0")
+	switch {
+	case r.Opcode == dns.OpcodeUpdate:
+		for _, rr := range r.Ns {
+			deleted := dns.Copy(rr)
+			deleted.Header().Class = dns.ClassINET
+			p.records = slices.DeleteFunc(p.records, func(rr dns.RR) bool {
+				return dns.IsDuplicate(rr, deleted)
+			})
+			if rr.Header().Class == dns.ClassINET {
+				p.records = append(p.records, rr)
+			}
+		}
+	case r.Question[0].Qtype == dns.TypeAXFR:
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: append(append([]dns.RR{soa}, p.records...), soa)}
+		close(ch)
+		tr := new(dns.Transfer)
+		tr.Out(w, r, ch) //nolint:errcheck
+		return
+	}
+	m.SetTsig(r.IsTsig().Hdr.Name, dns.HmacSHA256, 300, time.Now().Unix())
+	w.WriteMsg(m) //nolint:errcheck
+}
+
+// has tells whether the primary holds a record
+func (p *testPrimary) has(record string) bool {
+	rr, _ := dns.NewRR(record)
+
+	defer p.lock.Unlock()
+	p.lock.Lock()
+	return slices.ContainsFunc(p.records, func(other dns.RR) bool {
+		return dns.IsDuplicate(other, rr)
+	})
+}
+
+func TestExporter(t *testing.T) {
+	const TestAddr = "127.0.0.1:9976"
+	const PrimaryAddr = "127.0.0.1:9977"
+
+	secrets := map[string]string{"export.": "c2VjcmV0"}
+
+	primary := &testPrimary{zone: "docker."}
+	for _, record := range []string{
+		// left over by a previous run
+		"old.docker. 0 IN A 10.0.0.9",
+		"_dnsdock.old.docker. 0 IN TXT \"heritage=dnsdock,owner=dnsdock\"",
+		// added by other means
+		"manual.docker. 0 IN A 10.0.0.10",
+		"other.docker. 0 IN A 10.0.0.11",
+		"_dnsdock.other.docker. 0 IN TXT \"heritage=dnsdock,owner=other\"",
+	} {
+		rr, _ := dns.NewRR(record)
+		primary.records = append(primary.records, rr)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Addr: PrimaryAddr, Net: "tcp", Handler: primary, TsigSecret: secrets, MsgAcceptFunc: acceptMsg, NotifyStartedFunc: func() { close(started) }}
+	go server.ListenAndServe() //nolint:errcheck
+	defer server.Shutdown()    //nolint:errcheck
+	<-started
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.TsigKeys = secrets
+	config.ExportAddr = PrimaryAddr
+	config.ExportKey = "export."
+
+	s := NewDNSServer(config)
+	if res := s.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("10.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+	go s.Start() //nolint:errcheck
+
+	waitFor := func(message string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if cond() {
+				return
+			}
+		}
+		t.Error(message)
+	}
+
+	// the records are reconciled on startup
+	waitFor("Records of the services should be exported", func() bool {
+		return primary.has("foo.bar.docker. 0 IN A 10.0.0.1") &&
+			primary.has("_dnsdock.foo.bar.docker. 0 IN TXT \"heritage=dnsdock,owner=dnsdock\"")
+	})
+	waitFor("Stale records should be removed", func() bool {
+		return !primary.has("old.docker. 0 IN A 10.0.0.9")
+	})
+	if !primary.has("manual.docker. 0 IN A 10.0.0.10") || !primary.has("other.docker. 0 IN A 10.0.0.11") {
+		t.Error("Records which are not owned should be kept")
+	}
+	if primary.has("docker. 0 IN NS dnsdock.docker.") {
+		t.Error("NS record of the domain should not be exported")
+	}
+
+	// the records follow the services
+	if res := s.AddService("baz", Service{Name: "baz", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("10.0.0.2"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+	waitFor("Records of an added service should be exported", func() bool {
+		return primary.has("baz.bar.docker. 0 IN A 10.0.0.2")
+	})
+	if res := s.RemoveService("foo"); res != nil {
+		t.Error("Error removing service", res)
+	}
+	waitFor("Records of a removed service should be removed", func() bool {
+		return !primary.has("foo.bar.docker. 0 IN A 10.0.0.1") &&
+			!primary.has("_dnsdock.foo.bar.docker. 0 IN TXT \"heritage=dnsdock,owner=dnsdock\"")
+	})
+	if !primary.has("baz.bar.docker. 0 IN A 10.0.0.2") {
+		t.Error("Records of the other services should be kept")
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
@@ -0,0 +1,111 @@
+/* forward.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// ForwardRuleProvider represents the entrypoint to manage the forwarding rules
+type ForwardRuleProvider interface {
+	GetForwardRules() map[string][]string
+	SetForwardRule(string, []string) error
+	RemoveForwardRule(string) error
+}
+
+// GetForwardRules returns the nameservers of the forwarding rules by domain
+func (s *DNSServer) GetForwardRules() map[string][]string {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	rules := make(map[string][]string, len(s.forwardRules))
+	for domain, nameservers := range s.forwardRules {
+		rules[domain] = slices.Clone(nameservers)
+	}
+	return rules
+}
+
+// SetForwardRule forwards the queries of a domain and its subdomains to the
+// given nameservers
+func (s *DNSServer) SetForwardRule(domain string, nameservers []string) error {
+	domain, nameservers, err := utils.NormalizeForwardRule(domain, nameservers)
+	if err != nil {
+		return err
+	}
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return errors.New("Invalid domain: " + domain)
+	}
+
+	s.lock.Lock()
+	s.forwardRules[domain] = nameservers
+	s.lock.Unlock()
+
+	// the cached responses may come from other nameservers
+	s.cache.flush()
+	s.upstreams.setNameservers(s.allNameservers())
+
+	logger.Debugf("Forwarding '%s' to %s", domain, strings.Join(nameservers, " "))
+	return nil
+}
+
+// RemoveForwardRule removes the forwarding rule of a domain
+func (s *DNSServer) RemoveForwardRule(domain string) error {
+	domain = strings.ToLower(dns.Fqdn(domain))
+
+	s.lock.Lock()
+	_, ok := s.forwardRules[domain]
+	delete(s.forwardRules, domain)
+	s.lock.Unlock()
+
+	if !ok {
+		return errors.New("No such forwarding rule: " + domain)
+	}
+	s.cache.flush()
+	s.upstreams.setNameservers(s.allNameservers())
+
+	logger.Debugf("Removed forwarding rule of '%s'", domain)
+	return nil
+}
+
+// allNameservers returns the default nameservers and the ones of the
+// forwarding rules
+func (s *DNSServer) allNameservers() []string {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	nameservers := slices.Clone(s.defaultNameservers())
+	for _, rule := range s.forwardRules {
+		nameservers = append(nameservers, rule...)
+	}
+	return nameservers
+}
+
+// forwardNameservers returns the nameservers of the forwarding rule of the
+// longest domain matching a name, or the default nameservers
+func (s *DNSServer) forwardNameservers(name string) []string {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	for _, i := range dns.Split(name) {
+		if nameservers, ok := s.forwardRules[name[i:]]; ok {
+			return nameservers
+		}
+	}
+	if nameservers, ok := s.forwardRules["."]; ok {
+		return nameservers
+	}
+	return s.defaultNameservers()
+}
@@ -0,0 +1,98 @@
+/* forward_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// startUpstream starts a nameserver answering every query with an A record
+// of the given address after the given delay
+func startUpstream(t *testing.T, addr string, ip string, delay time.Duration) {
+	started := make(chan struct{})
+	upstream := &dns.Server{Addr: addr, Net: "udp", NotifyStartedFunc: func() { close(started) }, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		name := r.Question[0].Name
+		_, m := testResponse(name, dns.TypeA, dns.RcodeSuccess, []string{name + " 60 IN A " + ip}, nil)
+		m.Id = r.Id
+		w.WriteMsg(m) //nolint:errcheck
+	})}
+	go upstream.ListenAndServe() //nolint:errcheck
+	t.Cleanup(func() {
+		upstream.Shutdown() //nolint:errcheck
+	})
+	<-started
+}
+
+func TestForwardRules(t *testing.T) {
+	const TestAddr = "127.0.0.1:9982"
+	const DefaultAddr = "127.0.0.1:9983"
+	const CorpAddr = "127.0.0.1:9984"
+
+	startUpstream(t, DefaultAddr, "10.0.0.1", 0)
+	startUpstream(t, CorpAddr, "10.0.0.2", 0)
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{DefaultAddr}
+	config.ForwardRules = map[string][]string{"corp.example.com.": {CorpAddr}}
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	check := func(name string, expected string) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != expected {
+			t.Error(name, "Expected:", expected, "Got:", r.Answer)
+		}
+	}
+
+	check("www.example.com.", "10.0.0.1")
+	check("corp.example.com.", "10.0.0.2")
+	check("WWW.Corp.Example.com.", "10.0.0.2")
+	check("www.notcorp.example.com.", "10.0.0.1")
+
+	// the longest matching domain is used
+	if err := server.SetForwardRule("Example.COM", []string{CorpAddr}); err != nil {
+		t.Fatal("Error setting forwarding rule", err)
+	}
+	if err := server.SetForwardRule("www.corp.example.com", []string{DefaultAddr}); err != nil {
+		t.Fatal("Error setting forwarding rule", err)
+	}
+	check("www.example.com.", "10.0.0.2")
+	check("host.www.corp.example.com.", "10.0.0.1")
+	check("host.corp.example.com.", "10.0.0.2")
+
+	if err := server.RemoveForwardRule("www.corp.example.com."); err != nil {
+		t.Error("Error removing forwarding rule", err)
+	}
+	check("host.www.corp.example.com.", "10.0.0.2")
+	if err := server.RemoveForwardRule("missing.example.com"); err == nil {
+		t.Error("Removing a missing rule should fail")
+	}
+	if err := server.SetForwardRule("example.org", nil); err == nil {
+		t.Error("Rule without nameserver should be refused")
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
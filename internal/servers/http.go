@@ -10,6 +10,8 @@ package servers
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/aacebedo/dnsdock/internal/utils"
@@ -23,6 +25,7 @@ const HTTPProvider = "http"
 type HTTPServer struct {
 	config *utils.Config
 	list   ServiceListProvider
+	rules  ForwardRuleProvider
 	server *http.Server
 }
 
@@ -42,6 +45,25 @@ func NewHTTPServer(c *utils.Config, list ServiceListProvider) *HTTPServer {
 
 	router.HandleFunc("/set/ttl", s.setTTL).Methods("PUT")
 
+	// the forwarding rules of the DNS server can be changed at runtime
+	if rules, ok := list.(ForwardRuleProvider); ok {
+		s.rules = rules
+		router.HandleFunc("/forward", s.getForwardRules).Methods("GET")
+		router.HandleFunc("/forward/{domain}", s.setForwardRule).Methods("PUT")
+		router.HandleFunc("/forward/{domain}", s.removeForwardRule).Methods("DELETE")
+	}
+
+	// the DNS server also exposes its counters
+	if stats, ok := list.(StatsProvider); ok {
+		router.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			if err := json.NewEncoder(w).Encode(stats.Stats()); err != nil {
+				logger.Errorf("Encoding error: %s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}).Methods("GET")
+	}
+
 	s.server = &http.Server{Addr: c.HttpAddr, Handler: router}
 
 	return s
@@ -110,8 +132,8 @@ func (s *HTTPServer) addService(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if len(service.IPs) == 0 || service.IPs[0] == nil {
-		http.Error(w, "Property \"ip\" is required", http.StatusInternalServerError)
+	if (len(service.IPs) == 0 || service.IPs[0].IP == nil) && len(service.CNAME) == 0 {
+		http.Error(w, "Property \"ip\" or \"cname\" is required", http.StatusInternalServerError)
 		return
 	}
 
@@ -177,6 +199,28 @@ func (s *HTTPServer) updateService(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if ips, ok := input["ips"]; ok {
+		if values, ok := ips.([]interface{}); ok {
+			addrs := make([]Address, 0, len(values))
+			for _, value := range values {
+				str, _ := value.(string)
+				ip := net.ParseIP(str)
+				if ip == nil {
+					http.Error(w, fmt.Sprintf("Invalid IP address '%v'", value), http.StatusBadRequest)
+					return
+				}
+				addrs = append(addrs, Address{IP: ip})
+			}
+			service.IPs = addrs
+		}
+	}
+
+	if cname, ok := input["cname"]; ok {
+		if value, ok := cname.(string); ok {
+			service.CNAME = value
+		}
+	}
+
 	if image, ok := input["alias"]; ok {
 		if value, ok := image.([]string); ok {
 			service.Aliases = value
@@ -192,6 +236,50 @@ func (s *HTTPServer) updateService(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (s *HTTPServer) getForwardRules(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if err := json.NewEncoder(w).Encode(s.rules.GetForwardRules()); err != nil {
+		logger.Errorf("Encoding error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *HTTPServer) setForwardRule(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	domain, ok := vars["domain"]
+	if !ok {
+		http.Error(w, "Domain required", http.StatusBadRequest)
+		return
+	}
+
+	var nameservers []string
+	if err := json.NewDecoder(req.Body).Decode(&nameservers); err != nil {
+		logger.Errorf("JSON decoding error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.rules.SetForwardRule(domain, nameservers); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *HTTPServer) removeForwardRule(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	domain, ok := vars["domain"]
+	if !ok {
+		http.Error(w, "Domain required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.rules.RemoveForwardRule(domain); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
 func (s *HTTPServer) setTTL(w http.ResponseWriter, req *http.Request) {
 	var value int
 	if err := json.NewDecoder(req.Body).Decode(&value); err != nil {
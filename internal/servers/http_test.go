@@ -42,8 +42,30 @@ func TestServiceRequests(t *testing.T) {
 		{"GET", "/services", "", `{"boo":{"Name":"baz","Image":"bar","IPs":["127.0.0.2"],"TTL":-1,"Aliases":null},"foo":{"Name":"foo","Image":"bar","IPs":["127.0.0.1"],"TTL":-1,"Aliases":["foo.docker"]}}`, 200},
 		{"PATCH", "/services/boo", `{"name": "bar", "ttl": 20, "image": "bar"}`, "", 200},
 		{"GET", "/services/boo", "", `{"Name":"bar","Image":"bar","IPs":["127.0.0.2"],"TTL":20,"Aliases":null}`, 200},
+		{"PUT", "/services/six", `{"name": "six", "image": "bar", "ips": ["fd00::6"]}`, "", 200},
+		{"GET", "/services/six", "", `{"Name":"six","Image":"bar","IPs":["fd00::6"],"TTL":-1,"Aliases":null}`, 200},
+		{"PATCH", "/services/six", `{"ips": ["127.0.0.6", "fd00::7"]}`, "", 200},
+		{"GET", "/services/six", "", `{"Name":"six","Image":"bar","IPs":["127.0.0.6","fd00::7"],"TTL":-1,"Aliases":null}`, 200},
+		{"PATCH", "/services/six", `{"ips": ["not-an-ip"]}`, "", 400},
+		{"DELETE", "/services/six", ``, "", 200},
+		{"PUT", "/services/net", `{"name": "net", "image": "bar", "ips": [{"IP": "10.0.0.1", "Network": "front", "Subnet": "10.0.0.0/24"}, "10.0.1.1"]}`, "", 200},
+		{"GET", "/services/net", "", `{"Name":"net","Image":"bar","IPs":[{"IP":"10.0.0.1","Network":"front","Subnet":"10.0.0.0/24"},"10.0.1.1"],"TTL":-1,"Aliases":null}`, 200},
+		{"PUT", "/services/net", `{"name": "net", "image": "bar", "ips": [{"IP": "10.0.0.1", "Subnet": "10.0.0.0"}]}`, "", 500},
+		{"DELETE", "/services/net", ``, "", 200},
+		{"PUT", "/services/alias", `{"name": "alias", "image": "bar", "cname": "foo.bar.docker"}`, "", 200},
+		{"PATCH", "/services/alias", `{"cname": "baz.bar.docker"}`, "", 200},
+		{"GET", "/services/alias", "", `{"Name":"alias","Image":"bar","IPs":null,"TTL":-1,"Aliases":null,"CNAME":"baz.bar.docker"}`, 200},
+		{"DELETE", "/services/alias", ``, "", 200},
 		{"DELETE", "/services/foo", ``, "", 200},
 		{"GET", "/services", "", `{"boo":{"Name":"bar","Image":"bar","IPs":["127.0.0.2"],"TTL":20,"Aliases":null}}`, 200},
+		{"GET", "/forward", "", "{}", 200},
+		{"PUT", "/forward/Corp.Example.com", `["10.8.0.1", "10.8.0.2:5353"]`, "", 200},
+		{"PUT", "/forward/corp.example.org", `[]`, "", 400},
+		{"GET", "/forward", "", `{"corp.example.com.":["10.8.0.1:53","10.8.0.2:5353"]}`, 200},
+		{"DELETE", "/forward/corp.example.com", ``, "", 200},
+		{"DELETE", "/forward/corp.example.com", ``, "", 400},
+		{"GET", "/dns-query?dns=AAABAAABAAAAAAAAA2ZvbwNiYXIGZG9ja2VyAAABAAE", "", "", 404},
+		{"GET", "/stats", "", `{"Cache":{"Entries":0,"Hits":0,"Misses":0,"Stale":0,"Evictions":0},"Upstreams":{"8.8.8.8:53":{"Healthy":true,"Queries":0,"Errors":0,"Latency":0}},"Access":{"ZoneAllowed":0,"ZoneRefused":0,"RecursionAllowed":0,"RecursionRefused":0}}`, 200},
 	}
 
 	for _, input := range tests {
@@ -0,0 +1,114 @@
+/* ns.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"strings"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// nameServerIPs returns the addresses of the name server answered as glue.
+// The address of the DNS listener is used when none is configured and it is
+// not a wildcard address.
+func nameServerIPs(c *utils.Config) []net.IP {
+	addrs := c.NsAddrs
+	if len(addrs) == 0 {
+		if host, _, err := net.SplitHostPort(c.DnsAddr); err == nil {
+			addrs = []string{host}
+		}
+	}
+
+	res := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.IsUnspecified() {
+			if len(c.NsAddrs) > 0 {
+				logger.Warningf("Invalid name server address '%s' ignored", addr)
+			}
+			continue
+		}
+		res = append(res, ip)
+	}
+	return res
+}
+
+// zoneName returns the fully qualified form of a name which is relative to
+// the domain unless it ends with a dot
+func (s *DNSServer) zoneName(name string) string {
+	if dns.IsFqdn(name) {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name + "." + s.config.Domain.String() + ".")
+}
+
+// nameServer returns the name of the name server of the zone
+func (s *DNSServer) nameServer() string {
+	return s.zoneName(s.config.SoaMname)
+}
+
+// isZoneName tells whether a name is the apex of the zone or the name of its
+// name server, which exist even without any service
+func (s *DNSServer) isZoneName(name string) bool {
+	domain := s.config.Domain.String() + "."
+	if strings.EqualFold(name, domain) {
+		return true
+	}
+	return strings.EqualFold(name, s.nameServer()) && dns.IsSubDomain(domain, name)
+}
+
+// makeZoneNS returns the NS record of the zone for queries at its apex and
+// the addresses of the name server for queries of its name. The addresses are
+// added as glue to the NS record when the name server is part of the domain.
+func (s *DNSServer) makeZoneNS(qname string, qtype uint16) (answer []dns.RR, extra []dns.RR) {
+	domain := s.config.Domain.String() + "."
+	ns := s.nameServer()
+
+	answer = make([]dns.RR, 0, 2)
+	if strings.EqualFold(qname, domain) && qtype == dns.TypeNS {
+		answer = append(answer, s.makeNS())
+		if dns.IsSubDomain(domain, ns) {
+			extra = append(extra, s.makeNSAddresses(ns, dns.TypeA)...)
+			extra = append(extra, s.makeNSAddresses(ns, dns.TypeAAAA)...)
+		}
+	}
+	if strings.EqualFold(qname, ns) && dns.IsSubDomain(domain, ns) {
+		answer = append(answer, s.makeNSAddresses(qname, qtype)...)
+	}
+	return
+}
+
+// makeNS returns the NS record of the zone
+func (s *DNSServer) makeNS() dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   s.config.Domain.String() + ".",
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(s.config.Ttl),
+		},
+		Ns: s.nameServer(),
+	}
+}
+
+// makeNSAddresses returns the A or AAAA records of the name server
+func (s *DNSServer) makeNSAddresses(n string, qtype uint16) []dns.RR {
+	rrs := make([]dns.RR, 0, len(s.nsIPs))
+	hdr := dns.RR_Header{Name: n, Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(s.config.Ttl)}
+	for _, ip := range s.nsIPs {
+		if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && qtype == dns.TypeAAAA {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,102 @@
+/* ns_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+func TestZoneNS(t *testing.T) {
+	const TestAddr = "127.0.0.1:9973"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.SoaMname = "ns1"
+	config.SoaRname = "hostmaster@example.com."
+	config.SoaRefresh = 3600
+	config.SoaRetry = 600
+	config.SoaExpire = 86400
+	config.SoaNegTtl = 30
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r, _, err := new(dns.Client).Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return r
+	}
+	serial := func() uint32 {
+		r := exchange("docker.", dns.TypeSOA)
+		if len(r.Answer) != 1 {
+			t.Fatal("Expected a SOA record Got:", r.Answer)
+		}
+		return r.Answer[0].(*dns.SOA).Serial
+	}
+
+	r := exchange("docker.", dns.TypeSOA)
+	if len(r.Answer) != 1 {
+		t.Fatal("Expected a SOA record Got:", r.Answer)
+	}
+	soa := r.Answer[0].(*dns.SOA)
+	if soa.Ns != "ns1.docker." || soa.Mbox != "hostmaster.example.com." || soa.Refresh != 3600 ||
+		soa.Retry != 600 || soa.Expire != 86400 || soa.Minttl != 30 || soa.Hdr.Ttl != 30 {
+		t.Error("SOA record should use the configured fields Got:", soa)
+	}
+
+	// the serial is increased on every change of the zone
+	initial := serial()
+	if res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("10.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+	added := serial()
+	if added <= initial {
+		t.Error("Serial should increase when a service is added", initial, added)
+	}
+	if res := server.RemoveService("foo"); res != nil {
+		t.Error("Error removing service", res)
+	}
+	if removed := serial(); removed <= added {
+		t.Error("Serial should increase when a service is removed", added, removed)
+	}
+
+	// the NS record comes with the address of the name server
+	r = exchange("docker.", dns.TypeNS)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != "ns1.docker." {
+		t.Error("Expected the NS record of the zone Got:", r.Answer)
+	}
+	if len(r.Extra) != 1 || r.Extra[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Error("Expected the address of the name server as glue Got:", r.Extra)
+	}
+
+	r = exchange("ns1.docker.", dns.TypeA)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Error("Expected the address of the name server Got:", r.Answer)
+	}
+	r = exchange("ns1.docker.", dns.TypeAAAA)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Error("Expected an empty answer for the name server Got:", r)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
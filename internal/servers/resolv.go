@@ -0,0 +1,244 @@
+/* resolv.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// the resolv.conf file is read again after this delay to detect its changes
+const resolvConfPollInterval = 2 * time.Second
+
+// resolvConf holds the settings of a resolv.conf file. The timeout and the
+// attempts are 0 when they are not set.
+type resolvConf struct {
+	nameservers []string
+	search      []string
+	ndots       int
+	timeout     time.Duration
+	attempts    int
+	rotate      bool
+}
+
+// parseResolvConf parses the content of a resolv.conf file as described in
+// resolv.conf(5), the nameservers which are not IP addresses are ignored
+func parseResolvConf(data []byte) *resolvConf {
+	rc := &resolvConf{ndots: 1}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			host, _, _ := strings.Cut(fields[1], "%")
+			if net.ParseIP(host) == nil {
+				logger.Warningf("Invalid nameserver '%s' ignored in resolv.conf", fields[1])
+				continue
+			}
+			rc.nameservers = append(rc.nameservers, fields[1])
+		case "domain":
+			rc.search = fields[1:2]
+		case "search":
+			rc.search = fields[1:]
+		case "options":
+			for _, option := range fields[1:] {
+				name, value, _ := strings.Cut(option, ":")
+				n, _ := strconv.Atoi(value)
+				switch name {
+				case "ndots":
+					rc.ndots = min(max(n, 0), 15)
+				case "timeout":
+					rc.timeout = time.Duration(min(max(n, 1), 30)) * time.Second
+				case "attempts":
+					rc.attempts = min(max(n, 1), 5)
+				case "rotate":
+					rc.rotate = true
+				}
+			}
+		}
+	}
+
+	for i, domain := range rc.search {
+		rc.search[i] = strings.ToLower(dns.Fqdn(domain))
+	}
+	return rc
+}
+
+// resolvWatcher reloads the resolv.conf file of a DNSServer when it changes
+type resolvWatcher struct {
+	server *DNSServer
+	path   string
+	data   []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newResolvWatcher creates a watcher of a resolv.conf file
+func newResolvWatcher(s *DNSServer, path string) *resolvWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &resolvWatcher{server: s, path: path, ctx: ctx, cancel: cancel}
+}
+
+// load reads the file and applies it to the server if its content changed
+func (w *resolvWatcher) load() error {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	if w.data != nil && bytes.Equal(data, w.data) {
+		return nil
+	}
+	if w.data != nil {
+		logger.Infof("Reloading '%s'", w.path)
+	}
+	w.data = data
+
+	w.server.setResolvConf(parseResolvConf(data))
+	return nil
+}
+
+// ListenAndServe polls the file until the watcher is shut down
+func (w *resolvWatcher) ListenAndServe() error {
+	ticker := time.NewTicker(resolvConfPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := w.load(); err != nil {
+				logger.Warningf("Unable to read '%s', keeping the previous nameservers: %s", w.path, err)
+			}
+		}
+	}
+}
+
+// Shutdown stops the watcher
+func (w *resolvWatcher) Shutdown() error {
+	w.cancel()
+	return nil
+}
+
+// setResolvConf forwards the queries to the nameservers of a resolv.conf file
+// with its options. The addresses of this server are skipped to not forward
+// the queries to itself.
+func (s *DNSServer) setResolvConf(rc *resolvConf) {
+	nameservers := make([]string, 0, len(rc.nameservers))
+	for _, ns := range rc.nameservers {
+		host, _, _ := strings.Cut(ns, "%")
+		if s.isOwnAddress(net.ParseIP(host)) {
+			logger.Debugf("Nameserver '%s' of resolv.conf is this server, it is skipped", ns)
+			continue
+		}
+		nameservers = append(nameservers, net.JoinHostPort(ns, "53"))
+	}
+	rc.nameservers = nameservers
+	if len(nameservers) == 0 {
+		logger.Warningf("No nameserver in resolv.conf, using %s", strings.Join(s.config.Nameservers, " "))
+	} else {
+		logger.Infof("Using the nameservers of resolv.conf: %s", strings.Join(nameservers, " "))
+	}
+
+	strategy, timeout, retries := s.config.UpstreamStrategy, s.config.UpstreamTimeout, s.config.UpstreamRetries
+	if rc.rotate {
+		strategy = StrategyRoundRobin
+	}
+	if rc.timeout > 0 {
+		timeout = rc.timeout
+	}
+	if rc.attempts > 0 {
+		retries = rc.attempts - 1
+	}
+
+	s.lock.Lock()
+	s.resolv = rc
+	s.lock.Unlock()
+
+	s.upstreams.setOptions(strategy, timeout, retries)
+	s.upstreams.setNameservers(s.allNameservers())
+	s.cache.flush()
+}
+
+// isOwnAddress tells whether the port 53 of an address reaches this server,
+// either through the DNS listener or an address of the name server
+func (s *DNSServer) isOwnAddress(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, addr := range s.config.NsAddrs {
+		if ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+
+	host, port, err := net.SplitHostPort(s.config.DnsAddr)
+	if err != nil || port != "53" {
+		return false
+	}
+	if listen := net.ParseIP(host); listen != nil && !listen.IsUnspecified() {
+		return ip.Equal(listen)
+	}
+
+	// the listener accepts the queries sent to any address of the host
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warningf("Unable to list the addresses of the host: %s", err)
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return ip.IsLoopback()
+}
+
+// defaultNameservers returns the nameservers of the queries without
+// forwarding rule, the lock must be held by the caller
+func (s *DNSServer) defaultNameservers() []string {
+	if s.resolv != nil && len(s.resolv.nameservers) > 0 {
+		return s.resolv.nameservers
+	}
+	return s.config.Nameservers
+}
+
+// searchNames returns the names built from a name with the search domains of
+// resolv.conf, when it has fewer dots than the ndots option. The names of the
+// zone are not forwarded.
+func (s *DNSServer) searchNames(name string) []string {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	if s.resolv == nil || name == "." || dns.CountLabel(name)-1 >= s.resolv.ndots {
+		return nil
+	}
+
+	zone := s.config.Domain.String() + "."
+	names := make([]string, 0, len(s.resolv.search))
+	for _, domain := range s.resolv.search {
+		expanded := dns.Fqdn(strings.TrimSuffix(name, ".") + "." + domain)
+		if _, ok := dns.IsDomainName(expanded); ok && !dns.IsSubDomain(zone, expanded) {
+			names = append(names, expanded)
+		}
+	}
+	return names
+}
@@ -0,0 +1,139 @@
+/* resolv_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+func TestResolvConfParsing(t *testing.T) {
+	rc := parseResolvConf([]byte(`# generated by NetworkManager
+nameserver 10.0.0.53
+nameserver fe80::1%eth0
+nameserver dns.example
+; domain corp.example.com
+search Corp.Example.com example.com.
+options ndots:3 timeout:0 attempts:9 rotate edns0
+`))
+
+	if !slices.Equal(rc.nameservers, []string{"10.0.0.53", "fe80::1%eth0"}) {
+		t.Error("Unexpected nameservers", rc.nameservers)
+	}
+	if !slices.Equal(rc.search, []string{"corp.example.com.", "example.com."}) {
+		t.Error("Unexpected search domains", rc.search)
+	}
+	if rc.ndots != 3 || rc.timeout != time.Second || rc.attempts != 5 || !rc.rotate {
+		t.Error("Unexpected options", rc)
+	}
+
+	if rc := parseResolvConf([]byte("nameserver 10.0.0.53\n")); rc.ndots != 1 || rc.timeout != 0 || rc.attempts != 0 || rc.rotate {
+		t.Error("Unexpected default options", rc)
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	const TestAddr = "127.0.0.1:9992"
+	const UpstreamAddr = "127.0.0.1:9993"
+
+	startUpstream(t, UpstreamAddr, "10.0.0.1", 0)
+
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("nameserver 10.255.255.1\nsearch corp.example.com\noptions ndots:2 timeout:1 attempts:3 rotate\n")
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.ResolvConf = path
+	config.ForwardRules = map[string][]string{"corp.example.com.": {UpstreamAddr}}
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	if stats := server.Stats(); len(stats.Upstreams) != 2 {
+		t.Error("Expected the nameservers of resolv.conf and of the forwarding rule", stats.Upstreams)
+	}
+	if strategy, timeout, retries := server.upstreams.options(); strategy != StrategyRoundRobin || timeout != time.Second || retries != 2 {
+		t.Error("Unexpected upstream options", strategy, timeout, retries)
+	}
+
+	// the names with fewer dots than ndots are searched
+	m := new(dns.Msg)
+	m.SetQuestion("wiki.", dns.TypeA)
+	r, _, err := new(dns.Client).Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	// the answer of the expanded name is returned without added records
+	if r.Question[0].Name != "wiki." || len(r.Answer) != 1 || r.Answer[0].Header().Name != "wiki.corp.example.com." || r.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Error("Expected the answer of the search domain Got:", r)
+	}
+	if names := server.searchNames("wiki.corp.example."); len(names) != 0 {
+		t.Error("Names with enough dots should not be searched", names)
+	}
+
+	// the file is watched
+	write("nameserver 10.255.255.2\n")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, ok := server.Stats().Upstreams["10.255.255.2:53"]; ok {
+			break
+		}
+	}
+	if stats := server.Stats(); len(stats.Upstreams) != 2 || stats.Upstreams["10.255.255.2:53"].Queries != 0 {
+		t.Error("Expected the nameservers of the modified resolv.conf", stats.Upstreams)
+	}
+	if strategy, timeout, retries := server.upstreams.options(); strategy != config.UpstreamStrategy || timeout != config.UpstreamTimeout || retries != config.UpstreamRetries {
+		t.Error("Expected the configured upstream options", strategy, timeout, retries)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
+
+func TestResolvConfOwnAddress(t *testing.T) {
+	config := utils.NewConfig()
+	config.DnsAddr = "127.0.0.1:53"
+	server := NewDNSServer(config)
+
+	server.setResolvConf(parseResolvConf([]byte("nameserver 127.0.0.1\nnameserver 10.0.0.53\nnameserver 10.0.0.54\n")))
+	if nameservers := server.forwardNameservers("example.com."); !slices.Equal(nameservers, []string{"10.0.0.53:53", "10.0.0.54:53"}) {
+		t.Error("The address of the server should be skipped", nameservers)
+	}
+
+	config.NsAddrs = []string{"10.0.0.53", "10.0.0.54"}
+	server.setResolvConf(parseResolvConf([]byte("nameserver 127.0.0.1\nnameserver 10.0.0.53\nnameserver 10.0.0.54\n")))
+	if nameservers := server.forwardNameservers("example.com."); !slices.Equal(nameservers, config.Nameservers) {
+		t.Error("Expected the configured nameservers", nameservers)
+	}
+
+	// the wildcard listener accepts the queries sent to the loopback addresses
+	config.DnsAddr = ":53"
+	if !server.isOwnAddress(net.ParseIP("127.0.0.53")) || server.isOwnAddress(net.ParseIP("192.0.2.1")) {
+		t.Error("Unexpected own addresses of the wildcard listener")
+	}
+	config.DnsAddr = ":5353"
+	if server.isOwnAddress(net.ParseIP("127.0.0.1")) {
+		t.Error("The server is not reached on port 53")
+	}
+}
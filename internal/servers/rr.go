@@ -0,0 +1,104 @@
+/* rr.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseRecord parses a resource record in zone file syntax. Relative names are
+// completed with the origin and the TTL is used when the record has none.
+func parseRecord(origin string, ttl int, record string) (dns.RR, error) {
+	rr, err := dns.NewRR(fmt.Sprintf("$ORIGIN %s\n$TTL %d\n%s", dns.Fqdn(origin), ttl, record))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty record")
+	}
+	// records without rdata are only meaningful in dynamic updates
+	if len(strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))) == 0 {
+		return nil, fmt.Errorf("missing rdata")
+	}
+	return rr, nil
+}
+
+// parseServiceRecords parses the user defined records of a service. Their
+// owner names are relative to the name of the service and must be part of the
+// domain or of an alias of the service. Invalid records are skipped.
+func (s *DNSServer) parseServiceRecords(service *Service) []dns.RR {
+	origin := s.serviceName(&serviceMatch{service: service})
+	zones := []string{s.config.Domain.String() + "."}
+	for _, alias := range service.Aliases {
+		zones = append(zones, dns.Fqdn(alias))
+	}
+
+	rrs := make([]dns.RR, 0, len(service.Records))
+	for _, record := range service.Records {
+		rr, err := parseRecord(origin, s.getTTL(service), record)
+		if err != nil {
+			logger.Warningf("Invalid record '%s' for service '%s': %s", record, service.Name, err)
+			continue
+		}
+
+		inZone := false
+		for _, zone := range zones {
+			inZone = inZone || dns.IsSubDomain(zone, rr.Header().Name)
+		}
+		if !inZone {
+			logger.Warningf("Record '%s' of service '%s' is outside of the domain and is ignored", rr, service.Name)
+			continue
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// queryRecords returns a copy of the user defined records owned by a name
+func (s *DNSServer) queryRecords(name string) []dns.RR {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	res := make([]dns.RR, 0)
+	for _, rrs := range s.records {
+		for _, rr := range rrs {
+			if strings.ToLower(rr.Header().Name) == name {
+				res = append(res, dns.Copy(rr))
+			}
+		}
+	}
+
+	return res
+}
+
+// filterRecords returns the records answering a query of the given type. The
+// CNAME records are returned if there is no record of the type.
+func filterRecords(rrs []dns.RR, qtype uint16) []dns.RR {
+	res := make([]dns.RR, 0, len(rrs))
+	cnames := make([]dns.RR, 0)
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case qtype:
+			res = append(res, rr)
+		case dns.TypeCNAME:
+			cnames = append(cnames, rr)
+		}
+	}
+
+	if len(res) == 0 {
+		return cnames
+	}
+	return res
+}
@@ -0,0 +1,119 @@
+/* srv.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Port represents a port exposed by a service
+type Port struct {
+	// Name is the service name used in SRV queries, the port number is used
+	// when it is empty
+	Name     string `json:",omitempty"`
+	Port     uint16
+	Protocol string
+}
+
+// ParsePort parses a port definition such as "8080/tcp". The protocol
+// defaults to tcp.
+func ParsePort(name string, value string) (Port, error) {
+	port, proto, _ := strings.Cut(value, "/")
+	if len(proto) == 0 {
+		proto = "tcp"
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return Port{}, fmt.Errorf("invalid port '%s'", value)
+	}
+
+	return Port{Name: strings.ToLower(name), Port: uint16(number), Protocol: strings.ToLower(proto)}, nil
+}
+
+func (p Port) String() string {
+	if len(p.Name) > 0 {
+		return fmt.Sprintf("%s=%d/%s", p.Name, p.Port, p.Protocol)
+	}
+	return fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+}
+
+// matches tells whether the port answers a SRV query for the given service
+// name and protocol. Empty values match any port.
+func (p Port) matches(name, proto string) bool {
+	if len(proto) > 0 && proto != p.Protocol {
+		return false
+	}
+	return len(name) == 0 || name == p.Name || name == strconv.Itoa(int(p.Port))
+}
+
+// splitSRVQuery splits a query such as _http._tcp.web.docker into the service
+// name, the protocol and the name of the target. The service name and the
+// protocol are empty if the query does not start with them.
+func splitSRVQuery(query string) (name, proto, target string) {
+	labels := strings.SplitN(strings.ToLower(query), ".", 3)
+	if len(labels) == 3 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		return labels[0][1:], labels[1][1:], labels[2]
+	}
+	return "", "", query
+}
+
+// serviceName returns the canonical name of a matched service, the name of
+// the service on the network when the match is restricted to a network
+func (s *DNSServer) serviceName(match *serviceMatch) string {
+	suffix := s.config.Domain.String() + "."
+	if len(match.network) > 0 {
+		suffix = match.network + "." + suffix
+	} else if len(match.service.Image) > 0 {
+		suffix = match.service.Image + "." + suffix
+	}
+
+	if len(match.service.Name) == 0 {
+		return suffix
+	}
+	return match.service.Name + "." + suffix
+}
+
+// makeServiceSRV creates the SRV records of the ports of a service matching
+// the given service name and protocol. The A and AAAA records of the target
+// are returned as extra records.
+func (s *DNSServer) makeServiceSRV(n string, match *serviceMatch, name, proto string, client net.IP) (rrs []dns.RR, extra []dns.RR) {
+	target := strings.ToLower(s.serviceName(match))
+	for _, port := range match.service.Ports {
+		if !port.matches(name, proto) {
+			continue
+		}
+
+		rr := new(dns.SRV)
+		rr.Hdr = dns.RR_Header{
+			Name:   n,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(s.getTTL(match.service)),
+		}
+		rr.Priority = 0
+		rr.Weight = 0
+		rr.Port = port.Port
+		rr.Target = target
+
+		rrs = append(rrs, rr)
+	}
+
+	if len(rrs) > 0 {
+		extra = append(extra, s.makeServiceA(target, match, client)...)
+		extra = append(extra, s.makeServiceAAAA(target, match, client)...)
+	}
+
+	return
+}
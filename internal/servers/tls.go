@@ -0,0 +1,100 @@
+/* tls.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate and reloads it when its files change on
+// disk. The previous certificate is kept if the new files cannot be loaded.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	lock     sync.Mutex
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// modified returns the latest modification time of the certificate files
+func (r *certReloader) modified() (time.Time, error) {
+	var res time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return res, err
+		}
+		if info.ModTime().After(res) {
+			res = info.ModTime()
+		}
+	}
+	return res, nil
+}
+
+// reload loads the certificate if its files changed since the last load
+func (r *certReloader) reload() error {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	return r.load()
+}
+
+// load loads the certificate if its files changed since the last attempt, the
+// lock must be held by the caller
+func (r *certReloader) load() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+	r.modTime = modTime
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if r.cert != nil {
+		logger.Infof("Reloaded certificate '%s'", r.certFile)
+	}
+	r.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the current certificate, it is used as
+// tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+
+	if err := r.load(); err != nil {
+		if r.cert == nil {
+			return nil, err
+		}
+		logger.Warningf("Unable to reload certificate '%s', using the previous one: %s", r.certFile, err)
+	}
+	return r.cert, nil
+}
+
+// tlsConfig creates a server TLS configuration using the certificate
+func (r *certReloader) tlsConfig(protos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		NextProtos:     protos,
+	}
+}
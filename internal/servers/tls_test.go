@@ -0,0 +1,136 @@
+/* tls_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 in the
+// given directory and returns the certificate pool trusting it
+func writeTestCertificate(t *testing.T, dir string, serial int64) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating key", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "dnsdock"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Error creating certificate", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("Error encoding key", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal("Error writing certificate", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal("Error writing key", err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return
+}
+
+// waitListening waits until a server listens on the given address: its TCP
+// listener accepts a connection or its UDP listener answers a query for the
+// default domain
+func waitListening(t *testing.T, network string, addr string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if network == "udp" {
+			c := &dns.Client{Timeout: 100 * time.Millisecond}
+			if _, _, err := c.Exchange(new(dns.Msg).SetQuestion("docker.", dns.TypeSOA), addr); err == nil {
+				return
+			}
+			continue
+		}
+		if conn, err := net.DialTimeout(network, addr, 100*time.Millisecond); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	t.Fatal("Server is not listening on", network, addr)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+
+	reloader := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if _, err := reloader.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("Missing certificate should fail")
+	}
+
+	serial := func() int64 {
+		cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal("Error getting certificate", err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+
+	certFile, keyFile, _ := writeTestCertificate(t, dir, 1)
+	if res := serial(); res != 1 {
+		t.Error("Expected certificate 1 Got:", res)
+	}
+
+	writeTestCertificate(t, dir, 2)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal("Error touching file", err)
+		}
+	}
+	if res := serial(); res != 2 {
+		t.Error("Expected reloaded certificate 2 Got:", res)
+	}
+
+	// invalid files keep the previous certificate
+	if err := os.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal("Error writing certificate", err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal("Error touching file", err)
+	}
+	if res := serial(); res != 2 {
+		t.Error("Expected previous certificate 2 Got:", res)
+	}
+}
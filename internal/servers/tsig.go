@@ -0,0 +1,105 @@
+/* tsig.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigValid tells whether a request is signed with one of the configured
+// TSIG keys
+func (s *DNSServer) tsigValid(w dns.ResponseWriter, r *dns.Msg) bool {
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return false
+	}
+	if _, ok := s.config.TsigKeys[tsig.Hdr.Name]; !ok {
+		return false
+	}
+	return w.TsigStatus() == nil
+}
+
+// checkTsig answers the requests signed with an unknown TSIG key or an invalid
+// signature with NOTAUTH. It returns false if the request must not be
+// processed further.
+func (s *DNSServer) checkTsig(w dns.ResponseWriter, r *dns.Msg) bool {
+	if r.IsTsig() == nil || s.tsigValid(w, r) {
+		return true
+	}
+
+	logger.Warningf("Invalid TSIG signature from remote '%s': %v", w.RemoteAddr(), w.TsigStatus())
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNotAuth)
+	res := w.WriteMsg(m)
+	if res != nil {
+		logger.Errorf("Unable to write response: '%s' ", res)
+	}
+	return false
+}
+
+// signTsig signs the response to a request signed with a valid TSIG key
+func (s *DNSServer) signTsig(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && s.tsigValid(w, r) && m.IsTsig() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+}
+
+// maxTsigMACSize is the size of the largest MAC of the supported algorithms
+// (HMAC-SHA512)
+const maxTsigMACSize = 64
+
+// tsigLen returns the maximum length of the TSIG record signing the response
+// to a request, it is 0 when the response is not signed
+func (s *DNSServer) tsigLen(w dns.ResponseWriter, r *dns.Msg) int {
+	tsig := r.IsTsig()
+	if tsig == nil || !s.tsigValid(w, r) {
+		return 0
+	}
+	rr := &dns.TSIG{
+		Hdr:       dns.RR_Header{Name: tsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm: tsig.Algorithm,
+		MACSize:   maxTsigMACSize,
+		MAC:       strings.Repeat("00", maxTsigMACSize),
+		// the time of the server is added to BADTIME errors
+		OtherLen:  6,
+		OtherData: strings.Repeat("00", 6),
+	}
+	return dns.Len(rr)
+}
+
+// truncateSigned truncates a response so that it still fits in size bytes
+// once its TSIG record of tsigLen bytes is added. The records are removed
+// from the end of the message when the minimum size of the truncation leaves
+// no room for the TSIG record.
+func truncateSigned(m *dns.Msg, size int, tsigLen int) {
+	m.Truncate(size - tsigLen)
+	for m.Len()+tsigLen > size {
+		// the OPT record is kept at the end of the additional section
+		extra := len(m.Extra)
+		if m.IsEdns0() != nil {
+			extra--
+		}
+		switch {
+		case extra > 0:
+			m.Extra = append(m.Extra[:extra-1], m.Extra[extra:]...)
+		case len(m.Ns) > 0:
+			m.Ns = m.Ns[:len(m.Ns)-1]
+			m.Truncated = true
+		case len(m.Answer) > 0:
+			m.Answer = m.Answer[:len(m.Answer)-1]
+			m.Truncated = true
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/* txt.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Metadata keys set by the providers on services
+const (
+	MetadataID      = "id"
+	MetadataImage   = "image"
+	MetadataCreated = "created"
+	// MetadataProvider is not stored in the metadata but read from the service
+	MetadataProvider = "provider"
+)
+
+// maxTXTLength is the maximum length of a character string of a TXT record
+const maxTXTLength = 255
+
+// splitTXT splits a string into character strings of at most maxTXTLength
+// bytes, which the clients concatenate. The backslashes are escaped since the
+// strings of the records are in presentation format.
+func splitTXT(value string) []string {
+	res := make([]string, 0, len(value)/maxTXTLength+1)
+	for len(value) > maxTXTLength {
+		res = append(res, strings.ReplaceAll(value[:maxTXTLength], `\`, `\\`))
+		value = value[maxTXTLength:]
+	}
+	return append(res, strings.ReplaceAll(value, `\`, `\\`))
+}
+
+// txtStrings returns the key=value strings describing a service, made of the
+// configured metadata fields and labels. The long values are split.
+func (s *DNSServer) txtStrings(service *Service) []string {
+	res := make([]string, 0, len(s.config.TxtFields)+len(s.config.TxtLabels))
+	for _, field := range s.config.TxtFields {
+		value := service.Metadata[field]
+		if field == MetadataProvider {
+			value = service.Provider
+		}
+		if len(value) > 0 {
+			res = append(res, splitTXT(field+"="+value)...)
+		}
+	}
+
+	for _, label := range s.config.TxtLabels {
+		if value, ok := service.Labels[label]; ok {
+			res = append(res, splitTXT(label+"="+value)...)
+		}
+	}
+
+	return res
+}
+
+// makeServiceTXT creates the TXT record holding the metadata of a service
+func (s *DNSServer) makeServiceTXT(n string, service *Service) []dns.RR {
+	txt := s.txtStrings(service)
+	if len(txt) == 0 {
+		return nil
+	}
+
+	rr := new(dns.TXT)
+	rr.Hdr = dns.RR_Header{
+		Name:   n,
+		Rrtype: dns.TypeTXT,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(s.getTTL(service)),
+	}
+	rr.Txt = txt
+
+	return []dns.RR{rr}
+}
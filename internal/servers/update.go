@@ -0,0 +1,386 @@
+/* update.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// UpdateProvider is the name of the provider used for services added by DNS
+// UPDATE messages
+const UpdateProvider = "dnsupdate"
+
+// acceptMsg accepts the UPDATE messages, which are rejected by the default
+// function of the dns package because their sections can hold any number of
+// records
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode == dns.OpcodeUpdate && !isResponse {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// updateAllowed tells whether a request is signed with one of the TSIG keys
+// allowed to send dynamic updates
+func (s *DNSServer) updateAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	return s.tsigValid(w, r) && slices.Contains(s.config.UpdateKeys, r.IsTsig().Hdr.Name)
+}
+
+// updateID returns the ID of the service holding the records of a name added
+// by dynamic updates
+func updateID(name string) string {
+	return UpdateProvider + ":" + strings.TrimSuffix(name, ".")
+}
+
+// handleUpdate processes the dynamic updates of RFC 2136. Every name of the
+// domain updated this way is a service of the UpdateProvider, the names of
+// the other services and the apex of the zone cannot be updated.
+func (s *DNSServer) handleUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		m.SetRcode(r, dns.RcodeFormatError)
+		s.writeMsg(w, r, m)
+		return
+	}
+	if !strings.EqualFold(r.Question[0].Name, s.config.Domain.String()+".") {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	if !s.updateAllowed(w, r) {
+		logger.Warningf("Dynamic update refused for remote '%s'", w.RemoteAddr())
+		m.SetRcode(r, dns.RcodeRefused)
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	// updates are applied one at a time for the prerequisites to hold
+	defer s.updateLock.Unlock()
+	s.updateLock.Lock()
+
+	zone := s.zoneByName()
+	rcode := s.checkPrerequisites(zone, r.Answer)
+	if rcode == dns.RcodeSuccess {
+		rcode = s.applyUpdate(zone, r.Ns)
+	}
+	if rcode != dns.RcodeSuccess {
+		logger.Debugf("Dynamic update from remote '%s' failed: %s", w.RemoteAddr(), dns.RcodeToString[rcode])
+	}
+
+	m.SetRcode(r, rcode)
+	s.writeMsg(w, r, m)
+}
+
+// zoneByName returns the records of the zone, including its SOA record,
+// indexed by lowercase owner name
+func (s *DNSServer) zoneByName() map[string][]dns.RR {
+	zone := make(map[string][]dns.RR)
+	for _, rr := range append(s.createSOA(), s.zoneRecords()...) {
+		name := strings.ToLower(rr.Header().Name)
+		zone[name] = append(zone[name], rr)
+	}
+	return zone
+}
+
+// checkPrerequisites checks the prerequisite section of an update as per RFC
+// 2136 sec. 3.2 and returns the rcode of the failure
+func (s *DNSServer) checkPrerequisites(zone map[string][]dns.RR, rrs []dns.RR) int {
+	domain := s.config.Domain.String() + "."
+
+	// RRsets which must exist with the given values, by name and type
+	required := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(domain, name) {
+			return dns.RcodeNotZone
+		}
+
+		existing := zone[name]
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY && len(existing) == 0 {
+				return dns.RcodeNameError
+			}
+			if hdr.Rrtype != dns.TypeANY && len(filterType(existing, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY && len(existing) > 0 {
+				return dns.RcodeYXDomain
+			}
+			if hdr.Rrtype != dns.TypeANY && len(filterType(existing, hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := name + " " + dns.TypeToString[hdr.Rrtype]
+			required[key] = append(required[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, rrset := range required {
+		existing := filterType(zone[strings.ToLower(rrset[0].Header().Name)], rrset[0].Header().Rrtype)
+		if !sameRRset(rrset, existing) {
+			return dns.RcodeNXRrset
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// applyUpdate checks the update section of an update as per RFC 2136 sec.
+// 3.4.1 and applies it. The names which are not owned by the UpdateProvider
+// are refused.
+func (s *DNSServer) applyUpdate(zone map[string][]dns.RR, rrs []dns.RR) int {
+	domain := s.config.Domain.String() + "."
+	owned := s.updateNames()
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(domain, name) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			if isMetaType(hdr.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 || (isMetaType(hdr.Rrtype) && hdr.Rrtype != dns.TypeANY) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || isMetaType(hdr.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+
+		if _, ok := owned[name]; !ok && (name == strings.ToLower(domain) || len(zone[name]) > 0) {
+			logger.Warningf("Dynamic update of '%s' refused: the name is not managed by dynamic updates", name)
+			return dns.RcodeRefused
+		}
+	}
+
+	// the records of the updated names, starting from the current ones
+	updated := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		current, ok := updated[name]
+		if !ok {
+			current = owned[name]
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			current = addRecord(current, rr)
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				current = nil
+			} else {
+				current = slices.DeleteFunc(current, func(rr dns.RR) bool {
+					return rr.Header().Rrtype == hdr.Rrtype
+				})
+			}
+		case dns.ClassNONE:
+			deleted := dns.Copy(rr)
+			deleted.Header().Class = dns.ClassINET
+			current = slices.DeleteFunc(current, func(rr dns.RR) bool {
+				return dns.IsDuplicate(rr, deleted)
+			})
+		}
+		updated[name] = current
+	}
+
+	// the services are all created before the zone is changed at once, so
+	// that a failure leaves it unchanged as per RFC 2136 sec. 3.4
+	services := make(map[string]*Service, len(updated))
+	records := make(map[string][]dns.RR, len(updated))
+	for name, rrs := range updated {
+		id := updateID(name)
+		if len(rrs) == 0 {
+			if _, ok := owned[name]; ok {
+				services[id] = nil
+			}
+			continue
+		}
+		service := s.updateService(name, rrs)
+		records[id] = s.parseServiceRecords(&service)
+		if len(records[id]) != len(service.Records) {
+			logger.Errorf("Unable to update '%s': invalid records", name)
+			return dns.RcodeServerFailure
+		}
+		services[id] = &service
+	}
+	s.setUpdateServices(services, records)
+
+	return dns.RcodeSuccess
+}
+
+// setUpdateServices replaces the services of the names managed by dynamic
+// updates, the nil ones are removed. The zone changes a single time.
+func (s *DNSServer) setUpdateServices(services map[string]*Service, records map[string][]dns.RR) {
+	if len(services) == 0 {
+		return
+	}
+
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	for id, service := range services {
+		if service == nil {
+			delete(s.services, id)
+			delete(s.records, id)
+			logger.Infof("Removed '%s' through a dynamic update", strings.TrimPrefix(id, UpdateProvider+":"))
+			continue
+		}
+		s.services[id] = service
+		s.records[id] = records[id]
+		logger.Infof("Updated '%s' through a dynamic update", strings.TrimPrefix(id, UpdateProvider+":"))
+	}
+	s.zoneChanged()
+}
+
+// updateNames returns the records of the names managed by dynamic updates
+func (s *DNSServer) updateNames() map[string][]dns.RR {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	res := make(map[string][]dns.RR)
+	for id, service := range s.services {
+		if service.Provider != UpdateProvider {
+			continue
+		}
+		match := &serviceMatch{service: service}
+		name := strings.ToLower(s.serviceName(match))
+
+		rrs := make([]dns.RR, 0)
+		if len(service.CNAME) > 0 {
+			rrs = append(rrs, s.makeServiceCNAME(name, service))
+		}
+		rrs = append(rrs, s.makeServiceA(name, match, nil)...)
+		rrs = append(rrs, s.makeServiceAAAA(name, match, nil)...)
+		for _, rr := range s.records[id] {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+		res[name] = rrs
+	}
+	return res
+}
+
+// updateService creates the service holding the records of a name managed by
+// dynamic updates. The addresses share the TTL of the last one.
+func (s *DNSServer) updateService(name string, rrs []dns.RR) Service {
+	service := NewService(UpdateProvider)
+	service.Name = strings.TrimSuffix(name, "."+strings.ToLower(s.config.Domain.String())+".")
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			service.IPs = append(service.IPs, Address{IP: rr.A})
+			service.TTL = int(rr.Hdr.Ttl)
+		case *dns.AAAA:
+			service.IPs = append(service.IPs, Address{IP: rr.AAAA})
+			service.TTL = int(rr.Hdr.Ttl)
+		case *dns.CNAME:
+			service.CNAME = rr.Target
+			service.TTL = int(rr.Hdr.Ttl)
+		default:
+			service.Records = append(service.Records, rr.String())
+		}
+	}
+	return *service
+}
+
+// addRecord adds a record to the records of a name as per RFC 2136 sec.
+// 3.4.2.2: a CNAME record replaces the current one and is ignored if the name
+// has other records, which are ignored if the name has a CNAME record. The
+// TTL of a record which already exists is updated.
+func addRecord(rrs []dns.RR, rr dns.RR) []dns.RR {
+	rrtype := rr.Header().Rrtype
+	if rrtype == dns.TypeSOA || rrtype == dns.TypeNS {
+		return rrs
+	}
+	for _, current := range rrs {
+		if (rrtype == dns.TypeCNAME) != (current.Header().Rrtype == dns.TypeCNAME) {
+			return rrs
+		}
+	}
+
+	rrs = slices.DeleteFunc(rrs, func(current dns.RR) bool {
+		return rrtype == dns.TypeCNAME || dns.IsDuplicate(current, rr)
+	})
+	return append(rrs, dns.Copy(rr))
+}
+
+// filterType returns the records of the given type
+func filterType(rrs []dns.RR, rrtype uint16) []dns.RR {
+	res := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+// sameRRset tells whether two RRsets hold the same records, regardless of
+// their TTL
+func sameRRset(a, b []dns.RR) bool {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		return slices.ContainsFunc(rrs, func(other dns.RR) bool {
+			return dns.IsDuplicate(other, rr)
+		})
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// isMetaType tells whether a type is only meaningful in queries
+func isMetaType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+	return false
+}
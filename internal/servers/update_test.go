@@ -0,0 +1,186 @@
+/* update_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+func TestDynamicUpdate(t *testing.T) {
+	const TestAddr = "127.0.0.1:9975"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.TsigKeys = map[string]string{"update.": "c2VjcmV0", "transfer.": "c2VjcmV0"}
+	config.UpdateKeys = []string{"update."}
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	if res := server.AddService("foo", Service{Name: "foo", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("10.0.0.1"))}); res != nil {
+		t.Error("Error adding service", res)
+	}
+
+	c := &dns.Client{TsigSecret: config.TsigKeys}
+	update := func(key string, insert []string, edit func(m *dns.Msg)) int {
+		parse := func(records []string) []dns.RR {
+			rrs := make([]dns.RR, 0, len(records))
+			for _, record := range records {
+				rr, err := dns.NewRR(record)
+				if err != nil {
+					t.Fatal("Invalid record", record, err)
+				}
+				rrs = append(rrs, rr)
+			}
+			return rrs
+		}
+
+		m := new(dns.Msg)
+		m.SetUpdate("docker.")
+		if edit != nil {
+			edit(m)
+		}
+		m.Insert(parse(insert))
+		if len(key) > 0 {
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return r.Rcode
+	}
+	lookup := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return r
+	}
+
+	// only signed updates with an allowed key are accepted
+	if rcode := update("", []string{"build.docker. 60 IN A 10.0.0.5"}, nil); rcode != dns.RcodeRefused {
+		t.Error("Unsigned update should be refused Got:", dns.RcodeToString[rcode])
+	}
+	if rcode := update("transfer.", []string{"build.docker. 60 IN A 10.0.0.5"}, nil); rcode != dns.RcodeRefused {
+		t.Error("Update signed with a key which is not allowed should be refused Got:", dns.RcodeToString[rcode])
+	}
+
+	insert := []string{"build.docker. 60 IN A 10.0.0.5", "build.docker. 60 IN TXT \"agent\""}
+	if rcode := update("update.", insert, nil); rcode != dns.RcodeSuccess {
+		t.Fatal("Update should succeed Got:", dns.RcodeToString[rcode])
+	}
+	if r := lookup("build.docker.", dns.TypeA); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.0.0.5" || r.Answer[0].Header().Ttl != 60 {
+		t.Error("Expected the added address Got:", r.Answer)
+	}
+	if r := lookup("build.docker.", dns.TypeTXT); len(r.Answer) == 0 {
+		t.Error("Expected the added TXT record Got:", r.Answer)
+	}
+	if service, err := server.GetService(updateID("build.docker.")); err != nil || service.Provider != UpdateProvider {
+		t.Error("Expected a service of the dnsupdate provider", service, err)
+	}
+
+	// an update of several names is applied at once with a single serial increase
+	serial := lookup("docker.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial
+	insert = []string{"first.docker. 60 IN A 10.0.0.9", "second.docker. 60 IN A 10.0.0.10", "second.docker. 60 IN TXT \"agent\""}
+	if rcode := update("update.", insert, nil); rcode != dns.RcodeSuccess {
+		t.Fatal("Update should succeed Got:", dns.RcodeToString[rcode])
+	}
+	if r := lookup("docker.", dns.TypeSOA); r.Answer[0].(*dns.SOA).Serial != serial+1 {
+		t.Error("Expected a single serial increase Got:", r.Answer[0].(*dns.SOA).Serial-serial)
+	}
+	if r := lookup("second.docker.", dns.TypeA); len(r.Answer) != 1 {
+		t.Error("Expected the address of the second name Got:", r.Answer)
+	}
+
+	// a refused update changes none of its names
+	insert = []string{"first.docker. 60 IN A 10.0.0.11", "foo.bar.docker. 60 IN A 10.0.0.11"}
+	if rcode := update("update.", insert, nil); rcode != dns.RcodeRefused {
+		t.Error("Update of a container should be refused Got:", dns.RcodeToString[rcode])
+	}
+	if r := lookup("first.docker.", dns.TypeA); len(r.Answer) != 1 {
+		t.Error("Expected the address of the first name only Got:", r.Answer)
+	}
+	if r := lookup("docker.", dns.TypeSOA); r.Answer[0].(*dns.SOA).Serial != serial+1 {
+		t.Error("Serial should not change on a refused update")
+	}
+
+	// prerequisites
+	var tests = []struct {
+		prereq func(*dns.Msg, []dns.RR)
+		rr     dns.RR
+		rcode  int
+	}{
+		{(*dns.Msg).NameUsed, &dns.ANY{Hdr: dns.RR_Header{Name: "missing.docker."}}, dns.RcodeNameError},
+		{(*dns.Msg).NameNotUsed, &dns.ANY{Hdr: dns.RR_Header{Name: "build.docker."}}, dns.RcodeYXDomain},
+		{(*dns.Msg).RRsetUsed, &dns.AAAA{Hdr: dns.RR_Header{Name: "build.docker.", Rrtype: dns.TypeAAAA}}, dns.RcodeNXRrset},
+		{(*dns.Msg).RRsetNotUsed, &dns.A{Hdr: dns.RR_Header{Name: "build.docker.", Rrtype: dns.TypeA}}, dns.RcodeYXRrset},
+		{(*dns.Msg).Used, &dns.A{Hdr: dns.RR_Header{Name: "build.docker.", Rrtype: dns.TypeA}, A: net.ParseIP("10.0.0.6")}, dns.RcodeNXRrset},
+		{(*dns.Msg).Used, &dns.A{Hdr: dns.RR_Header{Name: "build.docker.", Rrtype: dns.TypeA}, A: net.ParseIP("10.0.0.5")}, dns.RcodeSuccess},
+		{(*dns.Msg).RRsetUsed, &dns.A{Hdr: dns.RR_Header{Name: "foo.bar.docker.", Rrtype: dns.TypeA}}, dns.RcodeSuccess},
+	}
+	for i, input := range tests {
+		prereq := func(m *dns.Msg) { input.prereq(m, []dns.RR{input.rr}) }
+		rcode := update("update.", []string{"build.docker. 60 IN A 10.0.0.7"}, prereq)
+		if rcode != input.rcode {
+			t.Error(i, "Unexpected prerequisite result", dns.RcodeToString[rcode])
+		}
+	}
+	if r := lookup("build.docker.", dns.TypeA); len(r.Answer) != 2 {
+		t.Error("Expected the addresses added when the prerequisites are met Got:", r.Answer)
+	}
+
+	// the names of other services, the apex and names outside of the zone cannot be updated
+	if rcode := update("update.", []string{"foo.bar.docker. 60 IN A 10.0.0.8"}, nil); rcode != dns.RcodeRefused {
+		t.Error("Update of a container should be refused Got:", dns.RcodeToString[rcode])
+	}
+	if rcode := update("update.", []string{"docker. 60 IN A 10.0.0.8"}, nil); rcode != dns.RcodeRefused {
+		t.Error("Update of the apex should be refused Got:", dns.RcodeToString[rcode])
+	}
+	if rcode := update("update.", []string{"build.example.com. 60 IN A 10.0.0.8"}, nil); rcode != dns.RcodeNotZone {
+		t.Error("Update outside of the zone should fail Got:", dns.RcodeToString[rcode])
+	}
+
+	// deletions
+	remove := func(m *dns.Msg) {
+		m.Remove([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "build.docker.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("10.0.0.5")}})
+	}
+	if rcode := update("update.", nil, remove); rcode != dns.RcodeSuccess {
+		t.Error("Deletion should succeed Got:", dns.RcodeToString[rcode])
+	}
+	if r := lookup("build.docker.", dns.TypeA); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.0.0.7" {
+		t.Error("Expected the remaining address Got:", r.Answer)
+	}
+	remove = func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "build.docker."}}})
+	}
+	if rcode := update("update.", nil, remove); rcode != dns.RcodeSuccess {
+		t.Error("Deletion should succeed Got:", dns.RcodeToString[rcode])
+	}
+	if r := lookup("build.docker.", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		t.Error("Expected NXDOMAIN after the deletion of the name Got:", r)
+	}
+	if _, err := server.GetService(updateID("build.docker.")); err == nil {
+		t.Error("Service should be removed with its last record")
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
@@ -0,0 +1,527 @@
+/* upstream.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// Strategies selecting the nameservers of a query
+const (
+	// StrategySequential tries the nameservers in order
+	StrategySequential = "sequential"
+	// StrategyRoundRobin starts with the next nameserver on every query
+	StrategyRoundRobin = "round-robin"
+	// StrategyRandom tries the nameservers in a random order
+	StrategyRandom = "random"
+	// StrategyParallel queries all the nameservers and uses the first answer
+	StrategyParallel = "parallel"
+)
+
+const (
+	// a nameserver is taken out of rotation after this number of consecutive
+	// failed queries, until a health probe succeeds
+	upstreamMaxFails = 3
+	// maximum number of idle connections kept open to a nameserver
+	upstreamMaxIdleConns = 8
+)
+
+// UpstreamStats holds the counters of a nameserver
+type UpstreamStats struct {
+	Healthy bool
+	Queries uint64
+	Errors  uint64
+	// Latency is the moving average of the response time in nanoseconds
+	Latency time.Duration
+}
+
+// upstream is a nameserver the queries are forwarded to. The TCP and TLS
+// connections and the HTTPS client are reused by the queries.
+type upstream struct {
+	addr      string
+	ns        utils.Nameserver
+	err       error
+	tlsConfig *tls.Config
+	conns     chan *dns.Conn
+	client    *http.Client
+	fails     int
+	counters  UpstreamStats
+	lock      sync.Mutex
+}
+
+// newUpstream creates a nameserver from its address
+func newUpstream(addr string) *upstream {
+	u := &upstream{addr: addr, conns: make(chan *dns.Conn, upstreamMaxIdleConns), counters: UpstreamStats{Healthy: true}}
+	u.ns, u.err = utils.ParseNameserver(addr)
+	u.tlsConfig = &tls.Config{ServerName: u.ns.ServerName, MinVersion: tls.VersionTLS12}
+	if u.ns.Net == "https" {
+		u.client = &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     u.tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: upstreamMaxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+		}}
+	}
+	return u
+}
+
+// options returns the timeout and the retries of the queries to the
+// nameserver, the given ones are the defaults of the pool
+func (u *upstream) options(timeout time.Duration, retries int) (time.Duration, int) {
+	if u.ns.Timeout > 0 {
+		timeout = u.ns.Timeout
+	}
+	if u.ns.Retries >= 0 {
+		retries = u.ns.Retries
+	}
+	return timeout, retries
+}
+
+// query sends a query to the nameserver once. Truncated UDP responses are
+// retried over TCP.
+func (u *upstream) query(ctx context.Context, r *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	switch {
+	case u.err != nil:
+		return nil, 0, u.err
+	case u.ns.Net == "https":
+		return u.queryHTTPS(ctx, r, timeout)
+	case u.ns.Net == "tcp" || u.ns.Net == "tls":
+		return u.queryConn(ctx, r, timeout)
+	}
+
+	c := &dns.Client{Timeout: timeout}
+	in, rtt, err := c.ExchangeContext(ctx, r, u.ns.Addr)
+	if err == nil && in.Truncated {
+		logger.Debugf("Truncated response from nameserver '%s', retrying over TCP", u.addr)
+		return u.queryConn(ctx, r, timeout)
+	}
+	return in, rtt, err
+}
+
+// queryConn sends a query over an idle connection to the nameserver or a new
+// one. The connection is kept open for the next queries.
+func (u *upstream) queryConn(ctx context.Context, r *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	c := &dns.Client{Net: "tcp", Timeout: timeout}
+	if u.ns.Net == "tls" {
+		c.Net = "tcp-tls"
+		c.TLSConfig = u.tlsConfig
+	}
+
+	for {
+		var conn *dns.Conn
+		reused := true
+		select {
+		case conn = <-u.conns:
+		default:
+			var err error
+			if conn, err = c.DialContext(ctx, u.ns.Addr); err != nil {
+				return nil, 0, err
+			}
+			reused = false
+		}
+
+		in, rtt, err := c.ExchangeWithConnContext(ctx, r, conn)
+		if err != nil {
+			conn.Close()
+			// the nameserver may have closed the idle connection
+			var netErr net.Error
+			if reused && ctx.Err() == nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				continue
+			}
+			return nil, rtt, err
+		}
+
+		select {
+		case u.conns <- conn:
+		default:
+			conn.Close()
+		}
+		return in, rtt, nil
+	}
+}
+
+// queryHTTPS sends a query to a DNS-over-HTTPS nameserver (RFC 8484)
+func (u *upstream) queryHTTPS(ctx context.Context, r *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	// the ID is 0 to make the requests cacheable as per RFC 8484 sec. 4.1
+	m := r.Copy()
+	m.Id = 0
+	data, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.ns.Addr, bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", DoHMediaType)
+	req.Header.Set("Accept", DoHMediaType)
+
+	start := time.Now()
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err = io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+
+	in := new(dns.Msg)
+	if err := in.Unpack(data); err != nil {
+		return nil, rtt, err
+	}
+	in.Id = r.Id
+	return in, rtt, nil
+}
+
+// close closes the idle connections to the nameserver
+func (u *upstream) close() {
+	for {
+		select {
+		case conn := <-u.conns:
+			conn.Close()
+		default:
+			if u.client != nil {
+				u.client.CloseIdleConnections()
+			}
+			return
+		}
+	}
+}
+
+// record updates the counters and the health of the nameserver with the
+// result of a query
+func (u *upstream) record(rtt time.Duration, err error) {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	u.counters.Queries++
+	if err != nil {
+		u.counters.Errors++
+		u.fails++
+		if u.fails == upstreamMaxFails && u.counters.Healthy {
+			logger.Warningf("Nameserver '%s' failed %d times, it is taken out of rotation", u.addr, u.fails)
+			u.counters.Healthy = false
+		}
+		return
+	}
+
+	if u.counters.Latency == 0 {
+		u.counters.Latency = rtt
+	} else {
+		u.counters.Latency = (4*u.counters.Latency + rtt) / 5
+	}
+	u.fails = 0
+	if !u.counters.Healthy {
+		logger.Infof("Nameserver '%s' is back in rotation", u.addr)
+		u.counters.Healthy = true
+	}
+}
+
+// setHealthy updates the health of the nameserver with the result of a probe
+func (u *upstream) setHealthy(healthy bool) {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+
+	switch {
+	case healthy && !u.counters.Healthy:
+		logger.Infof("Nameserver '%s' is back in rotation", u.addr)
+		u.fails = 0
+	case !healthy && u.counters.Healthy:
+		logger.Warningf("Nameserver '%s' failed a health probe, it is taken out of rotation", u.addr)
+	}
+	u.counters.Healthy = healthy
+}
+
+// healthy tells whether the nameserver is in rotation
+func (u *upstream) healthy() bool {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+	return u.counters.Healthy
+}
+
+// stats returns the counters of the nameserver
+func (u *upstream) stats() UpstreamStats {
+	defer u.lock.Unlock()
+	u.lock.Lock()
+	return u.counters
+}
+
+// upstreamPool forwards the queries to the nameservers according to the
+// configured strategy. It is a listener probing the health of the
+// nameservers in the background.
+type upstreamPool struct {
+	config    *utils.Config
+	upstreams map[string]*upstream
+	strategy  string
+	timeout   time.Duration
+	retries   int
+	next      atomic.Uint32
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+}
+
+// newUpstreamPool creates a pool of nameservers with the configured options
+func newUpstreamPool(c *utils.Config) *upstreamPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &upstreamPool{config: c, upstreams: make(map[string]*upstream), ctx: ctx, cancel: cancel}
+	p.setOptions(c.UpstreamStrategy, c.UpstreamTimeout, c.UpstreamRetries)
+	return p
+}
+
+// setOptions changes the strategy, the timeout and the number of retries of
+// the queries
+func (p *upstreamPool) setOptions(strategy string, timeout time.Duration, retries int) {
+	defer p.lock.Unlock()
+	p.lock.Lock()
+
+	p.strategy, p.timeout, p.retries = strategy, timeout, retries
+}
+
+// options returns the strategy, the timeout and the number of retries of the
+// queries
+func (p *upstreamPool) options() (string, time.Duration, int) {
+	defer p.lock.Unlock()
+	p.lock.Lock()
+
+	return p.strategy, p.timeout, p.retries
+}
+
+// get returns the nameservers of the given addresses, the unknown ones are
+// added to the pool
+func (p *upstreamPool) get(addrs []string) []*upstream {
+	defer p.lock.Unlock()
+	p.lock.Lock()
+
+	res := make([]*upstream, 0, len(addrs))
+	for _, addr := range addrs {
+		u, ok := p.upstreams[addr]
+		if !ok {
+			u = newUpstream(addr)
+			p.upstreams[addr] = u
+		}
+		res = append(res, u)
+	}
+	return res
+}
+
+// setNameservers makes the pool hold the nameservers of the given addresses
+func (p *upstreamPool) setNameservers(addrs []string) {
+	p.get(addrs)
+
+	defer p.lock.Unlock()
+	p.lock.Lock()
+
+	for addr, u := range p.upstreams {
+		if !slices.Contains(addrs, addr) {
+			u.close()
+			delete(p.upstreams, addr)
+		}
+	}
+}
+
+// exchange sends a query to the given nameservers and returns the first
+// answer. The nameservers out of rotation are only tried when all of them are.
+func (p *upstreamPool) exchange(r *dns.Msg, addrs []string) (*dns.Msg, error) {
+	all := p.get(addrs)
+	upstreams := make([]*upstream, 0, len(all))
+	for _, u := range all {
+		if u.healthy() {
+			upstreams = append(upstreams, u)
+		}
+	}
+	if len(upstreams) == 0 {
+		upstreams = all
+	}
+	if len(upstreams) == 0 {
+		return nil, errors.New("no nameserver to forward to")
+	}
+
+	strategy, _, _ := p.options()
+	switch strategy {
+	case StrategyParallel:
+		return p.exchangeParallel(r, upstreams)
+	case StrategyRoundRobin:
+		i := int(p.next.Add(1)) % len(upstreams)
+		rotated := make([]*upstream, 0, len(upstreams))
+		upstreams = append(append(rotated, upstreams[i:]...), upstreams[:i]...)
+	case StrategyRandom:
+		rand.Shuffle(len(upstreams), func(i, j int) {
+			upstreams[i], upstreams[j] = upstreams[j], upstreams[i]
+		})
+	}
+
+	// look at each Nameserver, stop on success
+	var err error
+	for i, u := range upstreams {
+		logger.Debugf("Using Nameserver %s", u.addr)
+
+		var in *dns.Msg
+		if in, err = p.exchangeRetry(p.ctx, r, u); err == nil {
+			return in, nil
+		}
+
+		if i < (len(upstreams) - 1) {
+			logger.Debugf("DNS fowarding failed: trying next Nameserver...")
+		}
+	}
+	return nil, err
+}
+
+// exchangeParallel sends a query to all the nameservers and returns the first
+// answer, the other queries are cancelled
+func (p *upstreamPool) exchangeParallel(r *dns.Msg, upstreams []*upstream) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+
+	type result struct {
+		in  *dns.Msg
+		err error
+	}
+	results := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		go func(u *upstream) {
+			// the messages are packed concurrently
+			in, err := p.exchangeRetry(ctx, r.Copy(), u)
+			results <- result{in, err}
+		}(u)
+	}
+
+	var err error
+	for range upstreams {
+		res := <-results
+		if res.err == nil {
+			return res.in, nil
+		}
+		err = res.err
+	}
+	return nil, err
+}
+
+// exchangeRetry sends a query to a nameserver, it is sent again when the
+// nameserver does not answer
+func (p *upstreamPool) exchangeRetry(ctx context.Context, r *dns.Msg, u *upstream) (in *dns.Msg, err error) {
+	_, timeout, retries := p.options()
+	timeout, retries = u.options(timeout, retries)
+	for attempt := 0; attempt <= retries; attempt++ {
+		var rtt time.Duration
+		in, rtt, err = u.query(ctx, r, timeout)
+		if ctx.Err() != nil {
+			// the query was cancelled, it tells nothing about the nameserver
+			return nil, ctx.Err()
+		}
+		u.record(rtt, err)
+		if err == nil {
+			return in, nil
+		}
+		logger.Debugf("Query to nameserver '%s' failed: %s", u.addr, err)
+	}
+	return nil, err
+}
+
+// probe checks whether the nameservers answer, any response is fine
+func (p *upstreamPool) probe() {
+	p.lock.Lock()
+	upstreams := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		upstreams = append(upstreams, u)
+	}
+	p.lock.Unlock()
+
+	_, timeout, _ := p.options()
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion(".", dns.TypeNS)
+			timeout, _ := u.options(timeout, 0)
+			_, _, err := u.query(p.ctx, m, timeout)
+			if p.ctx.Err() == nil {
+				if err != nil {
+					logger.Debugf("Health probe of nameserver '%s' failed: %s", u.addr, err)
+				}
+				u.setHealthy(err == nil)
+			}
+		}(u)
+	}
+	wg.Wait()
+}
+
+// ListenAndServe probes the nameservers until the pool is shut down, the
+// probes are disabled when their interval is 0
+func (p *upstreamPool) ListenAndServe() error {
+	if p.config.UpstreamHealthInterval <= 0 {
+		<-p.ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(p.config.UpstreamHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return nil
+		case <-ticker.C:
+			p.probe()
+		}
+	}
+}
+
+// Shutdown stops the health probes, cancels the pending queries and closes
+// the connections to the nameservers
+func (p *upstreamPool) Shutdown() error {
+	p.cancel()
+
+	defer p.lock.Unlock()
+	p.lock.Lock()
+	for _, u := range p.upstreams {
+		u.close()
+	}
+	return nil
+}
+
+// stats returns the counters of the nameservers by address
+func (p *upstreamPool) stats() map[string]UpstreamStats {
+	defer p.lock.Unlock()
+	p.lock.Lock()
+
+	res := make(map[string]UpstreamStats, len(p.upstreams))
+	for addr, u := range p.upstreams {
+		res[addr] = u.stats()
+	}
+	return res
+}
@@ -0,0 +1,193 @@
+/* upstream_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamPool(t *testing.T) {
+	const FirstAddr = "127.0.0.1:9985"
+	const SecondAddr = "127.0.0.1:9986"
+	const SlowAddr = "127.0.0.1:9987"
+	// nothing listens on this address
+	const DeadAddr = "127.0.0.1:9988"
+
+	startUpstream(t, FirstAddr, "10.0.0.1", 0)
+	startUpstream(t, SecondAddr, "10.0.0.2", 0)
+	startUpstream(t, SlowAddr, "10.0.0.3", 500*time.Millisecond)
+
+	pool := newUpstreamPool(utils.NewConfig())
+	pool.setOptions(StrategySequential, time.Second, 1)
+
+	exchange := func(addrs ...string) string {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		r, err := pool.exchange(m, addrs)
+		if err != nil {
+			t.Fatal("Error response from the pool", err)
+		}
+		return r.Answer[0].(*dns.A).A.String()
+	}
+
+	// failing nameservers are taken out of rotation
+	for i := 0; i < 3; i++ {
+		if ip := exchange(DeadAddr, FirstAddr); ip != "10.0.0.1" {
+			t.Error("Expected the answer of the second nameserver Got:", ip)
+		}
+	}
+	stats := pool.stats()
+	if dead := stats[DeadAddr]; dead.Healthy || dead.Queries != 4 || dead.Errors != 4 {
+		t.Error("Dead nameserver should be out of rotation after being retried", dead)
+	}
+	if first := stats[FirstAddr]; !first.Healthy || first.Queries != 3 || first.Errors != 0 || first.Latency == 0 {
+		t.Error("Unexpected nameserver counters", first)
+	}
+
+	// the probes put the nameservers back in rotation
+	pool.setNameservers([]string{FirstAddr, DeadAddr})
+	startUpstream(t, DeadAddr, "10.0.0.4", 0)
+	pool.probe()
+	if stats := pool.stats(); !stats[DeadAddr].Healthy || len(stats) != 2 {
+		t.Error("Nameserver should be back in rotation", stats)
+	}
+	if ip := exchange(DeadAddr, FirstAddr); ip != "10.0.0.4" {
+		t.Error("Expected the answer of the first nameserver Got:", ip)
+	}
+
+	pool.setOptions(StrategyRoundRobin, time.Second, 1)
+	first, second := exchange(FirstAddr, SecondAddr), exchange(FirstAddr, SecondAddr)
+	if first == second {
+		t.Error("Round-robin should alternate the nameservers Got:", first, second)
+	}
+
+	pool.setOptions(StrategyParallel, time.Second, 1)
+	start := time.Now()
+	if ip := exchange(SlowAddr, SecondAddr); ip != "10.0.0.2" || time.Since(start) > 250*time.Millisecond {
+		t.Error("Expected the answer of the fastest nameserver Got:", ip, time.Since(start))
+	}
+
+	pool.setOptions(StrategyRandom, time.Second, 1)
+	if ip := exchange(FirstAddr); ip != "10.0.0.1" {
+		t.Error("Expected the answer of the nameserver Got:", ip)
+	}
+}
+
+func TestUpstreamOptions(t *testing.T) {
+	const ShortAddr = "127.0.0.1:9951"
+	const LongAddr = "127.0.0.1:9950"
+
+	startUpstream(t, ShortAddr, "10.0.0.1", 300*time.Millisecond)
+	startUpstream(t, LongAddr, "10.0.0.2", 300*time.Millisecond)
+
+	pool := newUpstreamPool(utils.NewConfig())
+	pool.setOptions(StrategySequential, 100*time.Millisecond, 1)
+
+	short, long := ShortAddr+"?retries=0&timeout=100ms", LongAddr+"?timeout=1s"
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	r, err := pool.exchange(m, []string{short, long})
+	if err != nil {
+		t.Fatal("Error response from the pool", err)
+	}
+	if ip := r.Answer[0].(*dns.A).A.String(); ip != "10.0.0.2" {
+		t.Error("Expected the answer of the nameserver with the longer timeout Got:", ip)
+	}
+
+	stats := pool.stats()
+	if s := stats[short]; s.Queries != 1 || s.Errors != 1 {
+		t.Error("Nameserver should time out once without retry", s)
+	}
+	if l := stats[long]; l.Queries != 1 || l.Errors != 0 {
+		t.Error("Nameserver should answer within its own timeout", l)
+	}
+}
+
+func TestEncryptedUpstreams(t *testing.T) {
+	const UpstreamAddr = "127.0.0.1:9989"
+	const DotAddr = "127.0.0.1:9990"
+	const DohAddr = "127.0.0.1:9991"
+
+	certFile, keyFile, certs := writeTestCertificate(t, t.TempDir(), 1)
+
+	// the upstream is another server answering for its zone
+	upstreamConfig := utils.NewConfig()
+	upstreamConfig.DnsAddr = UpstreamAddr
+	upstreamConfig.DotAddr = DotAddr
+	upstreamConfig.DotCert = certFile
+	upstreamConfig.DotKey = keyFile
+	upstreamConfig.DohAddr = DohAddr
+	upstreamConfig.DohCert = certFile
+	upstreamConfig.DohKey = keyFile
+
+	server := NewDNSServer(upstreamConfig)
+	ips := make([]net.IP, 0, 64)
+	for i := 1; i <= cap(ips); i++ {
+		ips = append(ips, net.IPv4(10, 0, 0, byte(i)))
+	}
+	if res := server.AddService("big", Service{Name: "big", Image: "bar", IPs: AddressesFromIPs(ips...)}); res != nil {
+		t.Error("Error adding service", res)
+	}
+	go server.Start()   //nolint:errcheck
+	defer server.Stop() //nolint:errcheck
+
+	waitListening(t, "udp", UpstreamAddr)
+	for _, addr := range []string{UpstreamAddr, DotAddr, DohAddr} {
+		waitListening(t, "tcp", addr)
+	}
+
+	pool := newUpstreamPool(utils.NewConfig())
+	defer pool.Shutdown() //nolint:errcheck
+
+	exchange := func(addr string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("big.bar.docker.", dns.TypeA)
+		r, err := pool.exchange(m, []string{addr})
+		if err != nil {
+			t.Fatal("Error response from", addr, err)
+		}
+		return r
+	}
+
+	var tests = []string{
+		// truncated responses are retried over TCP
+		UpstreamAddr,
+		"udp://" + UpstreamAddr,
+		"tcp://" + UpstreamAddr,
+		"tls://" + DotAddr,
+		"tls://" + DotAddr + "#127.0.0.1",
+		"https://" + DohAddr + DoHPath,
+	}
+	for _, addr := range tests {
+		t.Log(addr)
+		pool.get([]string{addr})[0].tlsConfig.RootCAs = certs
+		for i := 0; i < 2; i++ {
+			if r := exchange(addr); r.Truncated || len(r.Answer) != cap(ips) {
+				t.Error(addr, "Expected the complete answer Got:", len(r.Answer), "records")
+			}
+		}
+	}
+
+	// the connections are reused
+	for _, addr := range []string{"tcp://" + UpstreamAddr, "tls://" + DotAddr} {
+		if conns := len(pool.get([]string{addr})[0].conns); conns != 1 {
+			t.Error(addr, "Expected a single idle connection Got:", conns)
+		}
+	}
+
+	// the certificate of the nameserver is verified
+	if _, err := pool.exchange(new(dns.Msg).SetQuestion("big.bar.docker.", dns.TypeA), []string{"tls://" + DotAddr + "#dns.example"}); err == nil {
+		t.Error("Certificate of another name should be refused")
+	}
+}
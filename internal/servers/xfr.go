@@ -0,0 +1,279 @@
+/* xfr.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// number of records sent in each message of a zone transfer
+	xfrChunkSize = 100
+	// changes happening within this delay are notified once
+	notifyDelay = time.Second
+	// number of attempts to notify a secondary
+	notifyAttempts = 3
+)
+
+// zoneNames returns the names of the zone which are answered for a service
+// and the matches used to make their records: its canonical name, the name of
+// its image, its per network names and its aliases which are part of the domain
+func (s *DNSServer) zoneNames(service *Service) map[string]*serviceMatch {
+	domain := s.config.Domain.String() + "."
+	match := &serviceMatch{service: service}
+
+	names := make(map[string]*serviceMatch)
+	names[s.serviceName(match)] = match
+	if len(service.Name) > 0 && len(service.Image) > 0 {
+		names[service.Image+"."+domain] = match
+	}
+	for _, network := range service.sortedNetworks() {
+		match := &serviceMatch{service: service, network: network}
+		names[s.serviceName(match)] = match
+	}
+	for _, alias := range service.Aliases {
+		if dns.IsSubDomain(domain, dns.Fqdn(alias)) {
+			names[dns.Fqdn(alias)] = match
+		}
+	}
+
+	return names
+}
+
+// zoneRecords returns the records of the zone, without its SOA record, in
+// canonical order. Addresses are not ordered for a specific client.
+func (s *DNSServer) zoneRecords() []dns.RR {
+	domain := s.config.Domain.String() + "."
+
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	rrs, glue := s.makeZoneNS(domain, dns.TypeNS)
+	rrs = append(rrs, glue...)
+	for id, service := range s.services {
+		for n, match := range s.zoneNames(service) {
+			if len(service.CNAME) > 0 {
+				rrs = append(rrs, s.makeServiceCNAME(n, service))
+				continue
+			}
+
+			rrs = append(rrs, s.makeServiceA(n, match, nil)...)
+			rrs = append(rrs, s.makeServiceAAAA(n, match, nil)...)
+			if rr := s.makeServiceMX(n, match); rr != nil {
+				rrs = append(rrs, rr)
+			}
+			rrs = append(rrs, s.makeServiceTXT(n, service)...)
+			for _, port := range service.Ports {
+				name := port.Name
+				if len(name) == 0 {
+					name = strconv.Itoa(int(port.Port))
+				}
+				srv, _ := s.makeServiceSRV("_"+name+"._"+port.Protocol+"."+n, match, name, port.Protocol, nil)
+				rrs = append(rrs, srv...)
+			}
+		}
+
+		for _, rr := range s.records[id] {
+			if dns.IsSubDomain(domain, rr.Header().Name) {
+				rrs = append(rrs, dns.Copy(rr))
+			}
+		}
+	}
+
+	rrs = dns.Dedup(rrs, nil)
+	sort.SliceStable(rrs, func(i, j int) bool {
+		return canonicalLess(rrs[i], rrs[j])
+	})
+	return rrs
+}
+
+// canonicalLess orders records by owner name as per RFC 4034 sec. 6.1 and
+// then by type
+func canonicalLess(a, b dns.RR) bool {
+	an := dns.SplitDomainName(strings.ToLower(a.Header().Name))
+	bn := dns.SplitDomainName(strings.ToLower(b.Header().Name))
+	for i, j := len(an)-1, len(bn)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if an[i] != bn[j] {
+			return an[i] < bn[j]
+		}
+	}
+	if len(an) != len(bn) {
+		return len(an) < len(bn)
+	}
+	return a.Header().Rrtype < b.Header().Rrtype
+}
+
+// transferAllowed tells whether a client may transfer the zone: its address
+// must be allowed and the request signed if TSIG is required
+func (s *DNSServer) transferAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if !containsIP(s.xfrAllow, remoteIP(w.RemoteAddr())) {
+		return false
+	}
+	return !s.config.XfrRequireTsig || s.tsigValid(w, r)
+}
+
+// handleTransfer answers AXFR and IXFR requests. IXFR requests are answered
+// with the SOA record when the client is up to date and with the full zone
+// otherwise, as the history of the zone is not kept.
+func (s *DNSServer) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if !strings.EqualFold(r.Question[0].Name, s.config.Domain.String()+".") {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	if !s.transferAllowed(w, r) {
+		logger.Warningf("Zone transfer refused for remote '%s'", w.RemoteAddr())
+		m.SetRcode(r, dns.RcodeRefused)
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	soa := s.createSOA()
+	if r.Question[0].Qtype == dns.TypeIXFR {
+		for _, rr := range r.Ns {
+			if client, ok := rr.(*dns.SOA); ok && client.Serial == soa[0].(*dns.SOA).Serial {
+				m.Answer = soa
+				s.writeMsg(w, r, m)
+				return
+			}
+		}
+	}
+
+	// zone transfers are only sent over TCP, the client is told to retry
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		if r.Question[0].Qtype == dns.TypeIXFR {
+			m.Answer = soa
+		} else {
+			m.SetRcode(r, dns.RcodeRefused)
+		}
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	logger.Debugf("Zone transfer to remote '%s'", w.RemoteAddr())
+
+	rrs := append(append(soa, s.zoneRecords()...), soa...)
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for len(rrs) > 0 {
+			n := min(len(rrs), xfrChunkSize)
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+	}()
+
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, r, ch); err != nil {
+		logger.Errorf("Zone transfer to remote '%s' failed: %s", w.RemoteAddr(), err)
+		// drain the channel for the goroutine to stop
+		for range ch {
+		}
+	}
+}
+
+// zoneChanged is called when the zone changes, the lock must be held by the
+// caller
+func (s *DNSServer) zoneChanged() {
+	s.serial.Add(1)
+
+	if s.signer != nil {
+		s.signer.flush()
+	}
+	if s.exporter != nil {
+		s.exporter.changed()
+	}
+
+	if len(s.config.NotifyAddrs) == 0 {
+		return
+	}
+	if s.notifyTimer == nil {
+		s.notifyTimer = time.AfterFunc(notifyDelay, s.notify)
+	} else {
+		s.notifyTimer.Reset(notifyDelay)
+	}
+}
+
+// notify sends a NOTIFY message to the secondaries, signed with the notify
+// TSIG key if there is one
+func (s *DNSServer) notify() {
+	zone := s.config.Domain.String() + "."
+	key := s.config.NotifyKey
+
+	for _, addr := range s.config.NotifyAddrs {
+		go func(addr string) {
+			m := new(dns.Msg)
+			m.SetNotify(zone)
+			m.Answer = s.createSOA()
+			if len(key) > 0 {
+				m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+			}
+
+			c := &dns.Client{TsigSecret: s.config.TsigKeys}
+			for i := 0; i < notifyAttempts; i++ {
+				r, _, err := c.Exchange(m, addr)
+				if err == nil && r.Rcode == dns.RcodeSuccess {
+					logger.Debugf("Notified secondary '%s'", addr)
+					return
+				}
+				if err == nil {
+					logger.Debugf("Secondary '%s' answered NOTIFY with %s", addr, dns.RcodeToString[r.Rcode])
+				}
+			}
+			logger.Warningf("Unable to notify secondary '%s'", addr)
+		}(addr)
+	}
+}
+
+// parseNetworks parses a list of IP addresses and networks in CIDR notation.
+// Invalid entries are skipped.
+func parseNetworks(values []string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				logger.Warningf("Invalid network '%s' ignored", value)
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		res = append(res, network)
+	}
+	return res
+}
+
+// containsIP tells whether an IP is part of one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+/* xfr_test.go
+ *
+ * Copyright (C) 2016 Alexandre ACEBEDO
+ *
+ * This software may be modified and distributed under the terms
+ * of the MIT license.  See the LICENSE file for details.
+ */
+
+package servers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aacebedo/dnsdock/internal/utils"
+	"github.com/miekg/dns"
+)
+
+// transferZone transfers the zone and returns its records
+func transferZone(addr string, m *dns.Msg, secrets map[string]string) ([]dns.RR, error) {
+	tr := &dns.Transfer{TsigSecret: secrets}
+	envs, err := tr.In(m, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rrs := make([]dns.RR, 0)
+	for env := range envs {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs, nil
+}
+
+func TestZoneTransfer(t *testing.T) {
+	const TestAddr = "127.0.0.1:9970"
+	const NotifyAddr = "127.0.0.1:9971"
+
+	notified := make(chan *dns.Msg, 10)
+	secondary := &dns.Server{Addr: NotifyAddr, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		notified <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m) //nolint:errcheck
+	})}
+	go secondary.ListenAndServe() //nolint:errcheck
+	defer secondary.Shutdown()    //nolint:errcheck
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.XfrAllow = []string{"127.0.0.1"}
+	config.TsigKeys = map[string]string{"another.": "YW5vdGhlcg==", "transfer.": "c2VjcmV0"}
+	config.NotifyAddrs = []string{NotifyAddr}
+	config.NotifyKey = "transfer."
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	services := map[string]Service{
+		"foo":   {Name: "foo", Image: "bar", IPs: []Address{NewAddress(net.ParseIP("10.0.0.1"), "front", 24)}, Ports: []Port{{Name: "http", Port: 80, Protocol: "tcp"}}},
+		"baz":   {Name: "baz", Image: "bar", IPs: AddressesFromIPs(net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")), Aliases: []string{"www.docker", "www.example.com"}},
+		"alias": {Name: "alias", CNAME: "foo.bar.docker"},
+		"txt":   {Name: "txt", IPs: AddressesFromIPs(net.ParseIP("10.0.0.3")), Records: []string{"@ TXT hello", "sub A 10.0.0.4"}},
+	}
+	for id, service := range services {
+		service.TTL = -1
+		if res := server.AddService(id, service); res != nil {
+			t.Error("Error adding service", res)
+		}
+	}
+
+	// the changes are notified once
+	select {
+	case r := <-notified:
+		if r.Opcode != dns.OpcodeNotify || r.Question[0].Name != "docker." {
+			t.Error("Unexpected NOTIFY message", r)
+		}
+		if tsig := r.IsTsig(); tsig == nil || tsig.Hdr.Name != "transfer." {
+			t.Error("NOTIFY message should be signed with the notify key", r)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Secondary was not notified")
+	}
+	select {
+	case <-notified:
+		t.Error("Changes should be notified once")
+	case <-time.After(2 * notifyDelay):
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("docker.")
+	rrs, err := transferZone(TestAddr, m, nil)
+	if err != nil {
+		t.Fatal("Error transferring the zone", err)
+	}
+	if len(rrs) < 2 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("Zone transfer should start and end with the SOA record Got:", rrs)
+	}
+
+	expected := []string{
+		"foo.bar.docker.\t0\tIN\tA\t10.0.0.1",
+		"foo.front.docker.\t0\tIN\tA\t10.0.0.1",
+		"_http._tcp.foo.bar.docker.\t0\tIN\tSRV\t0 0 80 foo.bar.docker.",
+		"bar.docker.\t0\tIN\tA\t10.0.0.1",
+		"bar.docker.\t0\tIN\tA\t10.0.0.2",
+		"baz.bar.docker.\t0\tIN\tAAAA\tfd00::2",
+		"www.docker.\t0\tIN\tA\t10.0.0.2",
+		"alias.docker.\t0\tIN\tCNAME\tfoo.bar.docker.",
+		"txt.docker.\t0\tIN\tTXT\t\"hello\"",
+		"sub.txt.docker.\t0\tIN\tA\t10.0.0.4",
+	}
+	zone := make(map[string]bool)
+	for _, rr := range rrs {
+		zone[rr.String()] = true
+		if !dns.IsSubDomain("docker.", rr.Header().Name) {
+			t.Error("Record outside of the zone", rr)
+		}
+	}
+	for _, rr := range expected {
+		if !zone[rr] {
+			t.Error("Missing record", rr)
+		}
+	}
+
+	// IXFR is answered with the SOA record when the secondary is up to date
+	serial := rrs[0].(*dns.SOA).Serial
+	m.SetIxfr("docker.", serial, "ns.", "mbox.")
+	if res, err := transferZone(TestAddr, m, nil); err != nil || len(res) != 1 {
+		t.Error("IXFR of an up to date zone should return the SOA record", res, err)
+	}
+	m.SetIxfr("docker.", serial-1, "ns.", "mbox.")
+	if res, err := transferZone(TestAddr, m, nil); err != nil || len(res) != len(rrs) {
+		t.Error("IXFR of an outdated zone should return the full zone", len(res), err)
+	}
+
+	// zone transfers are not sent over UDP
+	m.SetAxfr("docker.")
+	if r, _, err := new(dns.Client).Exchange(m, TestAddr); err != nil || r.Rcode != dns.RcodeRefused {
+		t.Error("AXFR over UDP should be refused", r, err)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
+
+func TestZoneTransferTsig(t *testing.T) {
+	const TestAddr = "127.0.0.1:9974"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.XfrAllow = []string{"127.0.0.1"}
+	config.TsigKeys = map[string]string{"transfer.": "c2VjcmV0"}
+	config.XfrRequireTsig = true
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	m := new(dns.Msg)
+	m.SetAxfr("docker.")
+	if _, err := transferZone(TestAddr, m, nil); err == nil {
+		t.Error("Unsigned zone transfer should be refused")
+	}
+	m.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+	if res, err := transferZone(TestAddr, m, config.TsigKeys); err != nil || len(res) < 2 {
+		t.Error("Signed zone transfer should succeed", len(res), err)
+	}
+	m.SetAxfr("docker.")
+	m.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+	if _, err := transferZone(TestAddr, m, map[string]string{"transfer.": "d3Jvbmc="}); err == nil {
+		t.Error("Zone transfer with a wrong key should be refused")
+	}
+
+	// signed UDP answers are truncated with room left for the signature
+	ips := make([]net.IP, 0, 40)
+	for i := 1; i <= 40; i++ {
+		ips = append(ips, net.IPv4(10, 0, 0, byte(i)))
+	}
+	if res := server.AddService("big", Service{Name: "big", Image: "bar", IPs: AddressesFromIPs(ips...)}); res != nil {
+		t.Error("Error adding service", res)
+	}
+	m = new(dns.Msg)
+	m.SetQuestion("big.bar.docker.", dns.TypeA)
+	m.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+	c := &dns.Client{TsigSecret: config.TsigKeys}
+	r, _, err := c.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	r.Compress = true
+	if !r.Truncated || len(r.Answer) == 0 || r.IsTsig() == nil || r.Len() > dns.MinMsgSize {
+		t.Error("Expected a signed truncated answer Got:", r.Truncated, len(r.Answer), r.Len())
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
+
+func TestZoneTransferRefused(t *testing.T) {
+	const TestAddr = "127.0.0.1:9972"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.XfrAllow = []string{"10.0.0.0/8"}
+
+	server := NewDNSServer(config)
+	go server.Start() //nolint:errcheck
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	m := new(dns.Msg)
+	m.SetAxfr("docker.")
+	if _, err := transferZone(TestAddr, m, nil); err == nil {
+		t.Error("Zone transfer from a client which is not allowed should be refused")
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Error("Error stopping server", err)
+	}
+}
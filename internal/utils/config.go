@@ -9,8 +9,14 @@
 package utils
 
 import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Domain represents a domain
@@ -50,6 +56,206 @@ func (n *nameservers) Set(value string) error {
 	return nil
 }
 
+// Nameserver is a nameserver the queries are forwarded to
+type Nameserver struct {
+	// Net is the protocol of the nameserver: udp, tcp, tls or https
+	Net string
+	// Addr is the address of the nameserver, or its URL with https
+	Addr string
+	// ServerName is the name verified in the certificate of a tls nameserver
+	ServerName string
+	// Timeout and Retries replace the timeout and the number of retries of
+	// the queries for this nameserver, they are unset when 0 and -1
+	Timeout time.Duration
+	Retries int
+}
+
+// ParseNameserver parses the address of a nameserver. Plain addresses are
+// reached over UDP, the other protocols are selected with URLs like
+// tcp://10.0.0.1:53, tls://1.1.1.1:853#cloudflare-dns.com and
+// https://dns.example/dns-query. The port defaults to the one of the protocol.
+// The timeout and the retries of the queries are set with the timeout and
+// retries query parameters, as in tls://1.1.1.1?timeout=1s&retries=2.
+func ParseNameserver(value string) (Nameserver, error) {
+	value = strings.TrimSpace(value)
+	scheme, addr, ok := strings.Cut(value, "://")
+	if !ok {
+		scheme, addr = "udp", value
+	}
+
+	switch scheme {
+	case "https":
+		u, err := url.Parse(value)
+		if err != nil || len(u.Host) == 0 {
+			return Nameserver{}, fmt.Errorf("invalid nameserver URL '%s'", value)
+		}
+		// the other query parameters belong to the URL of the nameserver
+		ns := Nameserver{Net: scheme, Addr: value}
+		query, options := u.Query(), url.Values{}
+		for _, name := range []string{"timeout", "retries"} {
+			if query.Has(name) {
+				options[name] = query[name]
+				query.Del(name)
+			}
+		}
+		if err := ns.parseOptions(options, value); err != nil {
+			return Nameserver{}, err
+		}
+		if len(options) > 0 {
+			u.RawQuery = query.Encode()
+			ns.Addr = u.String()
+		}
+		return ns, nil
+	case "udp", "tcp", "tls":
+		addr, serverName, _ := strings.Cut(addr, "#")
+		addr, rawQuery, _ := strings.Cut(addr, "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return Nameserver{}, fmt.Errorf("invalid options of nameserver '%s'", value)
+		}
+		port := "53"
+		if scheme == "tls" {
+			port = "853"
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, port)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if len(host) == 0 {
+			return Nameserver{}, fmt.Errorf("invalid nameserver '%s'", value)
+		}
+		ns := Nameserver{Net: scheme, Addr: addr}
+		if err := ns.parseOptions(query, value); err != nil {
+			return Nameserver{}, err
+		}
+		if scheme == "tls" {
+			ns.ServerName = host
+			if len(serverName) > 0 {
+				ns.ServerName = serverName
+			}
+		}
+		return ns, nil
+	default:
+		return Nameserver{}, fmt.Errorf("unsupported protocol '%s' of nameserver '%s'", scheme, value)
+	}
+}
+
+// parseOptions reads the timeout and the retries of the nameserver from the
+// query parameters of its address
+func (ns *Nameserver) parseOptions(query url.Values, value string) error {
+	ns.Retries = -1
+	for name := range query {
+		switch name {
+		case "timeout":
+			timeout, err := time.ParseDuration(query.Get(name))
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid timeout '%s' of nameserver '%s'", query.Get(name), value)
+			}
+			ns.Timeout = timeout
+		case "retries":
+			retries, err := strconv.Atoi(query.Get(name))
+			if err != nil || retries < 0 {
+				return fmt.Errorf("invalid retries '%s' of nameserver '%s'", query.Get(name), value)
+			}
+			ns.Retries = retries
+		default:
+			return fmt.Errorf("unknown option '%s' of nameserver '%s'", name, value)
+		}
+	}
+	return nil
+}
+
+// String returns the address of the nameserver as parsed by ParseNameserver
+func (ns Nameserver) String() string {
+	res := ns.Net + "://" + ns.Addr
+	if ns.Net == "udp" || ns.Net == "https" {
+		res = ns.Addr
+	}
+
+	options := url.Values{}
+	if ns.Timeout > 0 {
+		options.Set("timeout", ns.Timeout.String())
+	}
+	if ns.Retries >= 0 {
+		options.Set("retries", strconv.Itoa(ns.Retries))
+	}
+	if len(options) > 0 {
+		if ns.Net == "https" && strings.Contains(res, "?") {
+			res += "&" + options.Encode()
+		} else {
+			res += "?" + options.Encode()
+		}
+	}
+
+	if ns.Net == "tls" {
+		if host, _, _ := net.SplitHostPort(ns.Addr); host != ns.ServerName {
+			res += "#" + ns.ServerName
+		}
+	}
+	return res
+}
+
+// NormalizeForwardRule checks a forwarding rule and returns its domain as a
+// fully qualified lowercase name and its nameservers as parsed by
+// ParseNameserver
+func NormalizeForwardRule(domain string, nameservers []string) (string, []string, error) {
+	domain = strings.TrimSpace(domain)
+	if len(domain) == 0 {
+		return "", nil, fmt.Errorf("forwarding rule without domain")
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, ".") + ".")
+
+	res := make([]string, 0, len(nameservers))
+	for _, value := range nameservers {
+		if len(strings.TrimSpace(value)) == 0 {
+			continue
+		}
+		ns, err := ParseNameserver(value)
+		if err != nil {
+			return "", nil, err
+		}
+		res = append(res, ns.String())
+	}
+	if len(res) == 0 {
+		return "", nil, fmt.Errorf("forwarding rule of '%s' without nameserver", domain)
+	}
+	return domain, res, nil
+}
+
+// ParseForwardRule parses a forwarding rule written as domain=nameserver,...
+func ParseForwardRule(rule string) (string, []string, error) {
+	domain, nameservers, ok := strings.Cut(rule, "=")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid forwarding rule '%s', expected domain=nameserver,...", rule)
+	}
+	return NormalizeForwardRule(domain, strings.Split(nameservers, ","))
+}
+
+// ReadForwardRules reads a file of forwarding rules, one per line. Empty
+// lines and lines starting with # are ignored.
+func ReadForwardRules(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimSpace(scanner.Text())
+		if len(rule) == 0 || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		domain, nameservers, err := ParseForwardRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		rules[domain] = nameservers
+	}
+	return rules, scanner.Err()
+}
+
 // Config contains DNSDock configuration
 type Config struct {
 	Nameservers nameservers
@@ -67,6 +273,111 @@ type Config struct {
 	Verbose     bool
 	Quiet       bool
 	All         bool
+	// DotAddr is the address of the DNS-over-TLS listener, which is enabled
+	// when DotCert and DotKey are set
+	DotAddr string
+	DotCert string
+	DotKey  string
+	// DoqAddr is the address of the DNS-over-QUIC listener, which is enabled
+	// when DoqCert and DoqKey are set. Idle connections and streams are
+	// closed after DoqIdleTimeout.
+	DoqAddr        string
+	DoqCert        string
+	DoqKey         string
+	DoqIdleTimeout time.Duration
+	// DohAddr is the address of the DNS-over-HTTPS listener, which uses TLS
+	// when DohCert and DohKey are set. DNS-over-HTTPS is disabled when it is
+	// empty.
+	DohAddr string
+	DohCert string
+	DohKey  string
+	// Dnssec enables the DNSSEC signing of the zone, the keys are loaded from
+	// DnssecKeyDir or generated in it if they do not exist
+	Dnssec       bool
+	DnssecKeyDir string
+	// TsigKeys maps the names of the TSIG keys to their base64 secrets
+	TsigKeys map[string]string
+	// XfrAllow lists the addresses and networks allowed to transfer the zone,
+	// which must also sign their requests when XfrRequireTsig is set
+	XfrAllow       []string
+	XfrRequireTsig bool
+	// UpdateKeys lists the names of the TSIG keys allowed to send dynamic
+	// updates, which are refused when it is empty
+	UpdateKeys []string
+	// ExportAddr is the address of a primary server which receives the
+	// records of the zone as dynamic updates, signed with the ExportKey TSIG
+	// key. The records are part of ExportZone, the domain by default, and
+	// marked as exported by ExportOwner.
+	ExportAddr  string
+	ExportZone  string
+	ExportKey   string
+	ExportOwner string
+	// NotifyAddrs lists the secondaries notified when the zone changes, with
+	// messages signed with the NotifyKey TSIG key if it is set
+	NotifyAddrs []string
+	NotifyKey   string
+	// SoaMname and SoaRname are the primary name server and the mailbox of
+	// the SOA record, relative to the domain unless they are fully qualified.
+	// SoaNegTtl is the TTL of negative answers, the TTL is used when it is -1.
+	SoaMname   string
+	SoaRname   string
+	SoaRefresh int
+	SoaRetry   int
+	SoaExpire  int
+	SoaNegTtl  int
+	// NsAddrs lists the addresses of the name server answered as glue, the
+	// address of the DNS listener is used when it is empty
+	NsAddrs []string
+	// ZoneAllow and RecursionAllow list the addresses and networks of the
+	// clients allowed to query the zone and to have their queries forwarded,
+	// the queries of the other clients are refused. The zone is open to every
+	// client by default, the forwarding to the loopback, private and
+	// link-local networks.
+	ZoneAllow      []string
+	RecursionAllow []string
+	// UpstreamStrategy selects the nameservers of the forwarded queries:
+	// sequential, round-robin, random or parallel. The queries time out after
+	// UpstreamTimeout and are sent UpstreamRetries more times to a nameserver
+	// before trying the next one. The nameservers are probed every
+	// UpstreamHealthInterval, the probes are disabled when it is 0.
+	UpstreamStrategy       string
+	UpstreamTimeout        time.Duration
+	UpstreamRetries        int
+	UpstreamHealthInterval time.Duration
+	// ResolvConf is the path of a resolv.conf file whose nameservers, search
+	// domains and options replace Nameservers and the upstream options. The
+	// file is read again when it changes.
+	ResolvConf string
+	// ForwardRules maps domains, as fully qualified lowercase names, to the
+	// nameservers their queries are forwarded to instead of Nameservers. The
+	// rule of the longest matching domain is used. The rules of ForwardFile
+	// are loaded on startup.
+	ForwardRules map[string][]string
+	ForwardFile  string
+	// CacheSize is the maximum number of forwarded responses kept in the
+	// cache, which is disabled when it is 0. Responses are cached at most
+	// CacheMaxTtl seconds, CacheNegTtl seconds for negative responses, and
+	// served stale for CacheStaleTtl seconds when the nameservers fail.
+	CacheSize     int
+	CacheMaxTtl   int
+	CacheNegTtl   int
+	CacheStaleTtl int
+	// NetworkOrder is the preferred order of the networks of a container
+	// when none of its addresses shares a subnet with the client
+	NetworkOrder []string
+	// LegacyMX answers MX queries for every service with the service itself
+	// as exchange
+	LegacyMX bool
+	// EdnsMaxUDPSize is the maximum size of UDP responses to EDNS0 clients,
+	// between 512 and 65535
+	EdnsMaxUDPSize int
+	// CnameMaxDepth is the maximum length of the CNAME chains followed to
+	// answer a query
+	CnameMaxDepth int
+	// TxtFields lists the metadata fields answered in TXT records
+	TxtFields []string
+	// TxtLabels lists the container labels answered in TXT records
+	TxtLabels []string
 }
 
 // NewConfig creates a new config
@@ -97,6 +408,31 @@ func NewConfig() *Config {
 		All:         false,
 		ForceTtl:    false,
 		Ttl:         0,
+
+		DotAddr:                ":853",
+		DoqAddr:                ":853",
+		DoqIdleTimeout:         30 * time.Second,
+		EdnsMaxUDPSize:         1232,
+		CnameMaxDepth:          8,
+		ZoneAllow:              []string{"0.0.0.0/0", "::/0"},
+		RecursionAllow:         []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", "fe80::/10"},
+		UpstreamStrategy:       "sequential",
+		UpstreamTimeout:        2 * time.Second,
+		UpstreamRetries:        1,
+		UpstreamHealthInterval: 10 * time.Second,
+		CacheSize:              10000,
+		CacheMaxTtl:            86400,
+		CacheNegTtl:            300,
+		CacheStaleTtl:          86400,
+		ExportOwner:            "dnsdock",
+		SoaMname:               "dnsdock",
+		SoaRname:               "dnsdock.dnsdock",
+		SoaRefresh:             28800,
+		SoaRetry:               7200,
+		SoaExpire:              604800,
+		SoaNegTtl:              -1,
+		TxtFields:              []string{"id", "image", "provider", "created"},
+		TxtLabels:              []string{"com.docker.compose.project"},
 	}
 
 }
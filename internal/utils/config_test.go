@@ -9,6 +9,10 @@
 package utils
 
 import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +33,86 @@ func TestDomainCreation(t *testing.T) {
 		}
 	}
 }
+
+func TestForwardRules(t *testing.T) {
+	var tests = []struct {
+		rule, domain string
+		nameservers  []string
+	}{
+		{"corp.example.com=10.8.0.1", "corp.example.com.", []string{"10.8.0.1:53"}},
+		{"Corp.Example.COM.=10.8.0.1:5353, fd00::1 ,[fd00::2]:53", "corp.example.com.", []string{"10.8.0.1:5353", "[fd00::1]:53", "[fd00::2]:53"}},
+		{".=9.9.9.9", ".", []string{"9.9.9.9:53"}},
+		{"corp.example.com", "", nil},
+		{"corp.example.com=", "", nil},
+		{"=10.8.0.1", "", nil},
+	}
+
+	for _, input := range tests {
+		t.Log(input.rule)
+		domain, nameservers, err := ParseForwardRule(input.rule)
+		if input.nameservers == nil {
+			if err == nil {
+				t.Error(input.rule, "Expected an error")
+			}
+			continue
+		}
+		if err != nil || domain != input.domain || !slices.Equal(nameservers, input.nameservers) {
+			t.Error(input.rule, "Expected:", input.domain, input.nameservers, "Got:", domain, nameservers, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "forward.conf")
+	content := "# corporate network\ncorp.example.com=10.8.0.1\n\nhome.lan=192.168.1.1,192.168.1.2\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ReadForwardRules(path)
+	if err != nil || len(rules) != 2 || !slices.Equal(rules["home.lan."], []string{"192.168.1.1:53", "192.168.1.2:53"}) {
+		t.Error("Unexpected rules", rules, err)
+	}
+
+	if err := os.WriteFile(path, []byte("corp.example.com=10.8.0.1\ninvalid\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadForwardRules(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Error("Expected an error on the invalid line Got:", err)
+	}
+}
+
+func TestNameserverParsing(t *testing.T) {
+	var tests = []struct {
+		value, net, addr, serverName, normalized string
+	}{
+		{"8.8.8.8", "udp", "8.8.8.8:53", "", "8.8.8.8:53"},
+		{"udp://8.8.8.8:5353", "udp", "8.8.8.8:5353", "", "8.8.8.8:5353"},
+		{"fd00::1", "udp", "[fd00::1]:53", "", "[fd00::1]:53"},
+		{"tcp://10.0.0.1", "tcp", "10.0.0.1:53", "", "tcp://10.0.0.1:53"},
+		{"tls://1.1.1.1#cloudflare-dns.com", "tls", "1.1.1.1:853", "cloudflare-dns.com", "tls://1.1.1.1:853#cloudflare-dns.com"},
+		{"tls://dns.example:8853", "tls", "dns.example:8853", "dns.example", "tls://dns.example:8853"},
+		{"https://dns.example/dns-query", "https", "https://dns.example/dns-query", "", "https://dns.example/dns-query"},
+		{"10.0.0.1?timeout=500ms", "udp", "10.0.0.1:53", "", "10.0.0.1:53?timeout=500ms"},
+		{"tls://1.1.1.1?timeout=1s&retries=2#cloudflare-dns.com", "tls", "1.1.1.1:853", "cloudflare-dns.com", "tls://1.1.1.1:853?retries=2&timeout=1s#cloudflare-dns.com"},
+		{"https://dns.example/dns-query?retries=0&timeout=2s", "https", "https://dns.example/dns-query", "", "https://dns.example/dns-query?retries=0&timeout=2s"},
+		{"https://dns.example/dns-query?key=abc&timeout=2s", "https", "https://dns.example/dns-query?key=abc", "", "https://dns.example/dns-query?key=abc&timeout=2s"},
+		{"tcp://10.0.0.1?timeout=fast", "", "", "", ""},
+		{"tcp://10.0.0.1?retries=-1", "", "", "", ""},
+		{"udp://10.0.0.1?tries=2", "", "", "", ""},
+		{"quic://dns.example", "", "", "", ""},
+		{"https:///dns-query", "", "", "", ""},
+		{"tcp://:53", "", "", "", ""},
+	}
+
+	for _, input := range tests {
+		t.Log(input.value)
+		ns, err := ParseNameserver(input.value)
+		if len(input.net) == 0 {
+			if err == nil {
+				t.Error(input.value, "Expected an error")
+			}
+			continue
+		}
+		if err != nil || ns.Net != input.net || ns.Addr != input.addr || ns.ServerName != input.serverName || ns.String() != input.normalized {
+			t.Error(input.value, "Expected:", input, "Got:", ns, ns.String(), err)
+		}
+	}
+}